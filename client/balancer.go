@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	_ "google.golang.org/grpc/health" // enables client-side health checking
+)
+
+const (
+	roundRobinPolicy   = "round_robin"
+	leastRequestPolicy = "least_request"
+	balancerPrefix     = "scorer_"
+)
+
+var lbPolicy = flag.String("lb-policy", roundRobinPolicy, "Load balancing across endpoints: round_robin or least_request")
+
+func init() {
+	balancer.Register(priorityBalancerBuilder{policy: roundRobinPolicy})
+	balancer.Register(priorityBalancerBuilder{policy: leastRequestPolicy})
+}
+
+// priorityBalancerBuilder gives every ClientConn its own picker builder, so
+// outstanding request counts and circuit breakers are not shared between
+// connections.
+type priorityBalancerBuilder struct {
+	policy string
+}
+
+func (b priorityBalancerBuilder) Name() string { return balancerPrefix + b.policy }
+
+func (b priorityBalancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pickerBuilder := &priorityPickerBuilder{
+		policy:      b.policy,
+		outstanding: map[balancer.SubConn]*int64{},
+		breakers:    map[string]*circuitBreaker{},
+	}
+	return base.NewBalancerBuilder(b.Name(), pickerBuilder, base.Config{HealthCheck: true}).Build(cc, opts)
+}
+
+// serviceConfig adds the balancer and health checking against the server's
+// gRPC health service to a service config, so unhealthy endpoints stop
+// receiving calls. Settings already present in the config are kept.
+func serviceConfig(policy string, base []byte) (string, error) {
+	if policy != roundRobinPolicy && policy != leastRequestPolicy {
+		return "", fmt.Errorf("unknown load balancing policy %q", policy)
+	}
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(base, &config); err != nil {
+		return "", fmt.Errorf("service config: %v", err)
+	}
+	if _, ok := config["loadBalancingConfig"]; !ok {
+		config["loadBalancingConfig"] = json.RawMessage(fmt.Sprintf(`[{"%s%s": {}}]`, balancerPrefix, policy))
+	}
+	if _, ok := config["healthCheckConfig"]; !ok {
+		config["healthCheckConfig"] = json.RawMessage(`{"serviceName": ""}`)
+	}
+	data, err := json.Marshal(config)
+	return string(data), err
+}
+
+// priorityPickerBuilder builds pickers that prefer the lowest priority group
+// with an available endpoint, so a secondary group takes over when every
+// endpoint of the primary is down, unhealthy or has an open circuit.
+type priorityPickerBuilder struct {
+	policy string
+
+	mu          sync.Mutex
+	outstanding map[balancer.SubConn]*int64
+	breakers    map[string]*circuitBreaker
+}
+
+func (b *priorityPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	picker := &priorityPicker{policy: b.policy}
+	var endpoints []*pickerEndpoint
+	b.mu.Lock()
+	for subConn := range b.outstanding {
+		if _, ok := info.ReadySCs[subConn]; !ok {
+			delete(b.outstanding, subConn)
+		}
+	}
+	for subConn, scInfo := range info.ReadySCs {
+		counter, ok := b.outstanding[subConn]
+		if !ok {
+			counter = new(int64)
+			b.outstanding[subConn] = counter
+		}
+		// Breakers are kept per address so reconnecting does not close a circuit.
+		breaker, ok := b.breakers[scInfo.Address.Addr]
+		if !ok {
+			breaker = newCircuitBreaker(scInfo.Address.Addr)
+			b.breakers[scInfo.Address.Addr] = breaker
+		}
+		endpoints = append(endpoints, &pickerEndpoint{
+			subConn:     subConn,
+			address:     scInfo.Address.Addr,
+			priority:    addressPriority(scInfo.Address),
+			outstanding: counter,
+			breaker:     breaker,
+		})
+	}
+	b.mu.Unlock()
+
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].priority != endpoints[j].priority {
+			return endpoints[i].priority < endpoints[j].priority
+		}
+		return endpoints[i].address < endpoints[j].address
+	})
+	for i, endpoint := range endpoints {
+		if i == 0 || endpoint.priority != endpoints[i-1].priority {
+			picker.groups = append(picker.groups, nil)
+		}
+		picker.groups[len(picker.groups)-1] = append(picker.groups[len(picker.groups)-1], endpoint)
+	}
+	return picker
+}
+
+type pickerEndpoint struct {
+	subConn     balancer.SubConn
+	address     string
+	priority    int
+	outstanding *int64
+	breaker     *circuitBreaker
+}
+
+type priorityPicker struct {
+	policy string
+	groups [][]*pickerEndpoint
+	next   uint32
+}
+
+func (p *priorityPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	start := int(atomic.AddUint32(&p.next, 1))
+	for _, group := range p.groups {
+		if chosen, probe := p.choose(group, start); chosen != nil {
+			atomic.AddInt64(chosen.outstanding, 1)
+			return balancer.PickResult{
+				SubConn: chosen.subConn,
+				Done: func(info balancer.DoneInfo) {
+					atomic.AddInt64(chosen.outstanding, -1)
+					chosen.breaker.record(info.Err, probe)
+				},
+			}, nil
+		}
+	}
+	return balancer.PickResult{}, errCircuitOpen
+}
+
+// choose picks an endpoint of the group whose circuit admits the call.
+// Round robin starts from a rotating offset; least request also uses it so
+// ties are spread across endpoints.
+func (p *priorityPicker) choose(group []*pickerEndpoint, start int) (*pickerEndpoint, bool) {
+	var candidates []*pickerEndpoint
+	for i := range group {
+		endpoint := group[(start+i)%len(group)]
+		if !endpoint.breaker.available() {
+			continue
+		}
+		if p.policy != leastRequestPolicy {
+			candidates = append(candidates, endpoint)
+			continue
+		}
+		if len(candidates) == 0 || atomic.LoadInt64(endpoint.outstanding) < atomic.LoadInt64(candidates[0].outstanding) {
+			candidates = append([]*pickerEndpoint{endpoint}, candidates...)
+		} else {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	for _, endpoint := range candidates {
+		if admitted, probe := endpoint.breaker.allow(); admitted {
+			return endpoint, probe
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const circuitOpenReason = "CIRCUIT_OPEN"
+
+var (
+	breakerFailures    = flag.Int("breaker-failures", 5, "Consecutive failures that open an endpoint's circuit, 0 disables")
+	breakerErrorRate   = flag.Float64("breaker-error-rate", 0.5, "Failure ratio within -breaker-window that opens an endpoint's circuit, 0 disables")
+	breakerMinRequests = flag.Int("breaker-min-requests", 20, "Calls needed within -breaker-window before the error rate is considered")
+	breakerWindow      = flag.Duration("breaker-window", 10*time.Second, "Window over which the error rate is measured")
+	breakerOpenTime    = flag.Duration("breaker-open-time", 10*time.Second, "How long a circuit stays open before probe requests are let through")
+	breakerProbes      = flag.Int("breaker-probes", 1, "Concurrent probe requests allowed while a circuit is half-open")
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker tracks the health of one endpoint from the outcome of its
+// calls. It opens on consecutive failures or a high error rate, rejects calls
+// for -breaker-open-time, then lets probes through and closes again once a
+// probe succeeds.
+type circuitBreaker struct {
+	address string
+
+	mu           sync.Mutex
+	state        circuitState
+	consecutive  int
+	windowStart  time.Time
+	requests     int
+	failures     int
+	openedAt     time.Time
+	activeProbes int
+}
+
+func newCircuitBreaker(address string) *circuitBreaker {
+	return &circuitBreaker{address: address, windowStart: time.Now()}
+}
+
+// available reports whether allow would currently admit a call.
+func (b *circuitBreaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	return b.state == circuitClosed || b.state == circuitHalfOpen && b.activeProbes < *breakerProbes
+}
+
+// allow admits a call, reserving a probe slot when the circuit is half-open.
+// It reports whether the call is a probe.
+func (b *circuitBreaker) allow() (admitted, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	switch b.state {
+	case circuitClosed:
+		return true, false
+	case circuitHalfOpen:
+		if b.activeProbes < *breakerProbes {
+			b.activeProbes++
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// record updates the breaker with the outcome of an admitted call.
+func (b *circuitBreaker) record(err error, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	failed := breakerFailure(err)
+	if probe {
+		b.activeProbes--
+		if b.state != circuitHalfOpen {
+			return
+		}
+		if failed {
+			b.trip(now, "probe failed")
+		} else {
+			b.reset(now)
+			log.Printf("Circuit for %s closed", b.address)
+		}
+		return
+	}
+	if b.state != circuitClosed {
+		return
+	}
+
+	if now.Sub(b.windowStart) >= *breakerWindow {
+		b.windowStart, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+	switch {
+	case *breakerFailures > 0 && b.consecutive >= *breakerFailures:
+		b.trip(now, "consecutive failures")
+	case *breakerErrorRate > 0 && b.requests >= *breakerMinRequests && float64(b.failures)/float64(b.requests) >= *breakerErrorRate:
+		b.trip(now, "error rate")
+	}
+}
+
+// advance moves an open circuit to half-open once the open time has passed.
+func (b *circuitBreaker) advance(now time.Time) {
+	if b.state == circuitOpen && now.Sub(b.openedAt) >= *breakerOpenTime {
+		b.state = circuitHalfOpen
+		log.Printf("Circuit for %s half-open, probing", b.address)
+	}
+}
+
+func (b *circuitBreaker) trip(now time.Time, reason string) {
+	log.Printf("Circuit for %s open: %s", b.address, reason)
+	b.state = circuitOpen
+	b.openedAt = now
+}
+
+func (b *circuitBreaker) reset(now time.Time) {
+	b.state = circuitClosed
+	b.consecutive = 0
+	b.windowStart, b.requests, b.failures = now, 0, 0
+}
+
+// breakerFailure reports whether a call outcome points at a sick server rather
+// than a bad request or a caller giving up.
+func breakerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown, codes.DataLoss, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// errCircuitOpen is returned without contacting any server when every ready
+// endpoint has an open circuit.
+var errCircuitOpen = func() error {
+	st, err := status.New(codes.Unavailable, "circuit breaker open for every endpoint").
+		WithDetails(&errdetails.ErrorInfo{Reason: circuitOpenReason, Domain: "azuremachinelearning.com/client"})
+	if err != nil {
+		panic(err)
+	}
+	return st.Err()
+}()
+
+// isCircuitOpen reports whether a call failed fast on open circuits.
+func isCircuitOpen(err error) bool {
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Reason == circuitOpenReason {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const openTime = 20 * time.Millisecond
+	consecutive := map[string]string{"breaker-failures": "3", "breaker-error-rate": "0"}
+	errorRate := map[string]string{"breaker-failures": "0", "breaker-error-rate": "0.5", "breaker-min-requests": "4"}
+	tests := []struct {
+		name  string
+		flags map[string]string
+		// steps are applied in order: ok, fail and bad record the outcome of
+		// an admitted call, hold admits a call without finishing it and wait
+		// lets the open time pass.
+		steps     []string
+		state     circuitState
+		available bool
+	}{
+		{name: "closed on success", flags: consecutive, steps: []string{"ok", "ok", "ok"}, state: circuitClosed, available: true},
+		{name: "consecutive failures open", flags: consecutive, steps: []string{"fail", "fail", "fail"}, state: circuitOpen},
+		{name: "success resets consecutive", flags: consecutive, steps: []string{"fail", "fail", "ok", "fail", "fail"}, state: circuitClosed, available: true},
+		{name: "bad requests do not count", flags: consecutive, steps: []string{"bad", "bad", "bad", "bad"}, state: circuitClosed, available: true},
+		{name: "error rate opens", flags: errorRate, steps: []string{"ok", "fail", "ok", "fail"}, state: circuitOpen},
+		{name: "error rate needs min requests", flags: errorRate, steps: []string{"fail", "fail", "fail"}, state: circuitClosed, available: true},
+		{name: "half-open after open time", flags: consecutive, steps: []string{"fail", "fail", "fail", "wait"}, state: circuitHalfOpen, available: true},
+		{name: "probes are limited", flags: consecutive, steps: []string{"fail", "fail", "fail", "wait", "hold"}, state: circuitHalfOpen},
+		{name: "probe success closes", flags: consecutive, steps: []string{"fail", "fail", "fail", "wait", "ok"}, state: circuitClosed, available: true},
+		{name: "probe failure reopens", flags: consecutive, steps: []string{"fail", "fail", "fail", "wait", "fail"}, state: circuitOpen},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlags(t, map[string]string{"breaker-window": "1m", "breaker-open-time": openTime.String(), "breaker-probes": "1"})
+			setFlags(t, test.flags)
+			breaker := newCircuitBreaker("test")
+			for i, step := range test.steps {
+				if step == "wait" {
+					time.Sleep(openTime)
+					continue
+				}
+				admitted, probe := breaker.allow()
+				if !admitted {
+					t.Fatalf("Step %d %s was not admitted", i, step)
+				}
+				switch step {
+				case "ok":
+					breaker.record(nil, probe)
+				case "fail":
+					breaker.record(status.Error(codes.Unavailable, "down"), probe)
+				case "bad":
+					breaker.record(status.Error(codes.InvalidArgument, "bad request"), probe)
+				}
+			}
+			available := breaker.available()
+			if breaker.state != test.state || available != test.available {
+				t.Errorf("Got state %d, available %v, want %d and %v", breaker.state, available, test.state, test.available)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	channelz "google.golang.org/grpc/channelz/service"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var printChannelz = flag.Bool("channelz", false, "Print channelz connection, subchannel and socket stats when the client exits")
+
+// channelzRegistrar captures the channelz service implementation, which reads
+// this process's channels directly, so no listener is needed to query it.
+type channelzRegistrar struct {
+	server channelzpb.ChannelzServer
+}
+
+func (r *channelzRegistrar) RegisterService(desc *grpc.ServiceDesc, impl interface{}) {
+	r.server = impl.(channelzpb.ChannelzServer)
+}
+
+// logChannelz prints the client's channels with their subchannels and
+// sockets, as a channelz tool would show them.
+func logChannelz() {
+	if !*printChannelz {
+		return
+	}
+	var registrar channelzRegistrar
+	channelz.RegisterChannelzServiceToServer(&registrar)
+	ctx := context.Background()
+	channels, err := registrar.server.GetTopChannels(ctx, &channelzpb.GetTopChannelsRequest{})
+	if err != nil {
+		fmt.Printf("Could not read channelz: %v\n", err)
+		return
+	}
+	for _, channel := range channels.GetChannel() {
+		printChannel(ctx, registrar.server, channel, "")
+	}
+}
+
+func printChannel(ctx context.Context, server channelzpb.ChannelzServer, channel *channelzpb.Channel, indent string) {
+	data := channel.GetData()
+	fmt.Printf("%sChannel %d %s %s\n", indent, channel.GetRef().GetChannelId(), data.GetTarget(), data.GetState().GetState())
+	printCalls(indent+"  ", data.GetCallsStarted(), data.GetCallsSucceeded(), data.GetCallsFailed(), data.GetLastCallStartedTimestamp())
+	for _, ref := range channel.GetChannelRef() {
+		nested, err := server.GetChannel(ctx, &channelzpb.GetChannelRequest{ChannelId: ref.GetChannelId()})
+		if err == nil {
+			printChannel(ctx, server, nested.GetChannel(), indent+"  ")
+		}
+	}
+	for _, ref := range channel.GetSubchannelRef() {
+		response, err := server.GetSubchannel(ctx, &channelzpb.GetSubchannelRequest{SubchannelId: ref.GetSubchannelId()})
+		if err != nil {
+			continue
+		}
+		subchannel := response.GetSubchannel()
+		data := subchannel.GetData()
+		fmt.Printf("%s  Subchannel %d %s\n", indent, ref.GetSubchannelId(), data.GetState().GetState())
+		printCalls(indent+"    ", data.GetCallsStarted(), data.GetCallsSucceeded(), data.GetCallsFailed(), data.GetLastCallStartedTimestamp())
+		for _, ref := range subchannel.GetSocketRef() {
+			socket, err := server.GetSocket(ctx, &channelzpb.GetSocketRequest{SocketId: ref.GetSocketId()})
+			if err == nil {
+				printSocket(indent+"    ", socket.GetSocket())
+			}
+		}
+	}
+}
+
+func printCalls(indent string, started, succeeded, failed int64, last *timestamppb.Timestamp) {
+	fmt.Printf("%scalls started %d, succeeded %d, failed %d", indent, started, succeeded, failed)
+	if last.IsValid() {
+		fmt.Printf(", last at %s", last.AsTime().Local().Format(time.RFC3339Nano))
+	}
+	fmt.Println()
+}
+
+func printSocket(indent string, socket *channelzpb.Socket) {
+	data := socket.GetData()
+	fmt.Printf("%sSocket %d %s -> %s\n", indent, socket.GetRef().GetSocketId(), formatAddress(socket.GetLocal()), formatAddress(socket.GetRemote()))
+	fmt.Printf("%s  streams started %d, succeeded %d, failed %d\n", indent, data.GetStreamsStarted(), data.GetStreamsSucceeded(), data.GetStreamsFailed())
+	fmt.Printf("%s  messages sent %d, received %d; keepalives sent %d\n", indent, data.GetMessagesSent(), data.GetMessagesReceived(), data.GetKeepAlivesSent())
+	fmt.Printf("%s  flow control window local %d, remote %d\n", indent, data.GetLocalFlowControlWindow().GetValue(), data.GetRemoteFlowControlWindow().GetValue())
+	if last := data.GetLastMessageReceivedTimestamp(); last.IsValid() {
+		fmt.Printf("%s  last message received at %s\n", indent, last.AsTime().Local().Format(time.RFC3339Nano))
+	}
+}
+
+func formatAddress(address *channelzpb.Address) string {
+	switch {
+	case address.GetTcpipAddress() != nil:
+		tcpip := address.GetTcpipAddress()
+		return net.JoinHostPort(net.IP(tcpip.GetIpAddress()).String(), strconv.Itoa(int(tcpip.GetPort())))
+	case address.GetUdsAddress() != nil:
+		return address.GetUdsAddress().GetFilename()
+	case address.GetOtherAddress() != nil:
+		return address.GetOtherAddress().GetName()
+	default:
+		return "?"
+	}
+}
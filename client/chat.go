@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc/metadata"
+)
+
+const chatSessionHeader = "x-chat-session"
+
+var chatSession = flag.String("chat-session", "new", "Chat session the Chat test reattaches to, new starts a conversation")
+
+// chatTurns is the conversation the Chat test plays. Running the test again
+// continues the same session, so the server answers with the earlier turns
+// as context.
+var chatTurns = []*pb.InferenceRequest{
+	{Role: "system", Prompt: "You are a weather bot."},
+	{Prompt: "Today is"},
+	{Prompt: "And tomorrow?"},
+}
+
+func testChat(client pb.ScorerClient, ctx context.Context) {
+	ctx = metadata.AppendToOutgoingContext(ctx, chatSessionHeader, *chatSession)
+	stream, err := client.BidirectionalScore(ctx)
+	if err != nil {
+		log.Printf("Could not start chat: %v", err)
+		return
+	}
+	turns := chatTurns
+	if *chatSession != "new" {
+		// The system message is already in the session's history.
+		turns = turns[1:]
+	}
+	go func() {
+		for _, request := range turns {
+			if err := stream.Send(request); err != nil {
+				return
+			}
+		}
+		stream.CloseSend()
+	}()
+
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Chat failed: %v", err)
+			return
+		}
+		log.Printf("Chat turn %d: %s", response.GetTurn(), response.GetResult())
+	}
+	if header, err := stream.Header(); err == nil {
+		if session := header.Get(chatSessionHeader); len(session) > 0 {
+			*chatSession = session[0]
+		}
+	}
+	log.Printf("Chat session %s, run Chat again to continue it", *chatSession)
+}
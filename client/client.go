@@ -3,31 +3,84 @@ package main
 import (
 	"bufio"
 	"context"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	pb "azuremachinelearning.com/scorer"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
+// Other endpoints used during development: ":5001" and
+// "ep-suriyak-onebox-2.eastus.inference.ml.azure.com".
+var address = flag.String("addr", "suriyakvm.westus2.cloudapp.azure.com:5001",
+	"Scoring server address: host:port, a list like a:5001,b:5001;backup:5001, dns:///host:port or file:///path")
+
+var bidiWindow = flag.Int("bidi-window", 4, "BiDi requests sent ahead of their responses")
+
+var dialTimeout = flag.Duration("dial-timeout", 20*time.Second, "How long to wait for a connection to the server before giving up")
+
 func main() {
-	//conn, err := grpc.Dial(":5001", grpc.WithInsecure(), grpc.WithBlock())
-	//conn, err := grpc.Dial("ep-suriyak-onebox-2.eastus.inference.ml.azure.com", grpc.WithInsecure(), grpc.WithBlock())
-	conn, err := grpc.Dial("suriyakvm.westus2.cloudapp.azure.com:5001", grpc.WithInsecure(), grpc.WithBlock())
+	flag.Parse()
+	baseConfig, err := loadServiceConfig()
+	if err != nil {
+		log.Fatalf("Could not read service config: %v", err)
+	}
+	policies, err := parseCallPolicies(baseConfig)
+	if err != nil {
+		log.Fatalf("Invalid service config: %v", err)
+	}
+	config, err := serviceConfig(*lbPolicy, baseConfig)
+	if err != nil {
+		log.Fatalf("Invalid flags: %v", err)
+	}
+	if err := setCompressor(*compressorFlag); err != nil {
+		log.Fatalf("Invalid flags: %v", err)
+	}
+	if *bidiWindow < 1 {
+		log.Fatalf("Invalid flags: -bidi-window must be at least 1")
+	}
+	if *dialTimeout <= 0 {
+		log.Fatalf("Invalid flags: -dial-timeout must be positive")
+	}
+	// Retries and hedging run in the interceptor, so gRPC's own retries stay off.
+	options := append([]grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithDefaultServiceConfig(config),
+		grpc.WithDisableRetry(),
+		grpc.WithChainUnaryInterceptor(compressionUnaryInterceptor, policies.unaryInterceptor),
+		grpc.WithStreamInterceptor(compressionStreamInterceptor),
+	}, dialOptions()...)
+	dialCtx, cancel := context.WithTimeout(context.Background(), *dialTimeout)
+	conn, err := grpc.DialContext(dialCtx, dialTarget(*address), options...)
+	cancel()
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
 	defer conn.Close()
 
 	testRPCtype := "Unary"
-	if len(os.Args) < 2 {
+	if flag.NArg() < 1 {
 		log.Printf("Not test RPC type provided, defaulting to Unary")
 	} else {
-		testRPCtype = os.Args[1]
+		testRPCtype = flag.Arg(0)
+	}
+
+	switch testRPCtype {
+	case "list", "describe", "invoke", "replay":
+		err := runReflectionCommand(conn, testRPCtype, flag.Args()[1:])
+		logChannelz()
+		if err != nil {
+			log.Fatalf("%s failed: %v", testRPCtype, err)
+		}
+		return
 	}
 
 	client := pb.NewScorerClient(conn)
@@ -55,6 +108,11 @@ func main() {
 				testBiDirectionStreaming(client, ctx)
 				break
 			}
+		case "Chat":
+			{
+				testChat(client, ctx)
+				break
+			}
 		case "All":
 			{
 				for i := 1; i <= 10; i++ {
@@ -64,16 +122,28 @@ func main() {
 			}
 		default:
 			{
-				log.Printf("No matching test found for %s, Supported values are Unary, cStream, sStream, BiDi, All", testRPCtype)
+				log.Printf("No matching test found for %s, Supported values are Unary, cStream, sStream, BiDi, Chat, All", testRPCtype)
 			}
 		}
 
+		logCompression()
+
 		reader := bufio.NewReader(os.Stdin)
-		log.Print("Enter next test type  Unary, cStream, sStream, BiDi, All, Exit: ")
+		log.Print("Enter next test type  Unary, cStream, sStream, BiDi, Chat, All, Exit, optionally followed by gzip, zstd, snappy or none: ")
 		text, _ := reader.ReadString('\n')
-		testRPCtype = strings.Trim(text, "\r\n")
+		fields := strings.Fields(text)
+		testRPCtype = ""
+		if len(fields) > 0 {
+			testRPCtype = fields[0]
+		}
+		if len(fields) > 1 {
+			if err := setCompressor(fields[1]); err != nil {
+				log.Print(err)
+			}
+		}
 		if testRPCtype == "Exit" || testRPCtype == "exit" {
 			log.Println("Exiting from program, closing the connection")
+			logChannelz()
 			cancel()
 			conn.Close()
 			return
@@ -83,11 +153,18 @@ func main() {
 }
 
 func testUnary(client pb.ScorerClient, ctx context.Context) {
-	r, err := client.Score(ctx, &pb.InferenceRequest{Prompt: "Today is"})
+	var header metadata.MD
+	var attempts int
+	r, err := client.Score(ctx, &pb.InferenceRequest{Prompt: "Today is"}, grpc.Header(&header), callAttempts(&attempts))
+	if isCircuitOpen(err) {
+		log.Printf("Unary rejected, every endpoint's circuit is open")
+		return
+	}
 	if err != nil {
-		log.Fatalf("could not process: %v", err)
+		log.Printf("Unary failed after %d attempts: %v", attempts, err)
+		return
 	}
-	log.Printf("Unary result %s", r.GetResult())
+	log.Printf("Unary result %s from %s after %d attempts", r.GetResult(), modelVersion(header), attempts)
 }
 
 func testClientStreaming(client pb.ScorerClient, ctx context.Context) {
@@ -113,13 +190,14 @@ func testClientStreaming(client pb.ScorerClient, ctx context.Context) {
 
 func testServerStreaming(client pb.ScorerClient, ctx context.Context) {
 	prompt := "Input size is "
-	stream, err := client.StreamingResponseScore(ctx, &pb.InferenceRequest{
+	stream, err := streamingResponseScore(ctx, client, &pb.InferenceRequest{
 		Prompt: prompt,
 	})
 
 	if err != nil {
 		log.Fatalf("Could not process server stream request: %v", err)
 	}
+	log.Printf("sStream Served by %s", modelVersion(stream.Header()))
 
 	for {
 		response, error := stream.Recv()
@@ -135,6 +213,9 @@ func testServerStreaming(client pb.ScorerClient, ctx context.Context) {
 	}
 }
 
+// testBiDirectionStreaming sends and receives concurrently. The sender keeps
+// at most bidi-window requests unanswered, and responses, which may arrive
+// in any order, are matched to requests by ID.
 func testBiDirectionStreaming(client pb.ScorerClient, ctx context.Context) {
 	stream, error := client.BidirectionalScore(ctx)
 	if error != nil {
@@ -142,22 +223,46 @@ func testBiDirectionStreaming(client pb.ScorerClient, ctx context.Context) {
 		return
 	}
 
-	for i := 0; i < 10; i++ {
-		err := stream.Send(&pb.InferenceRequest{
-			Prompt: fmt.Sprintf("%v", (i * i)),
-		})
-		if err != nil {
-			log.Printf("Error in Sending request in BiDirectional client %v", err)
-		}
-
-		if i%2 == 0 {
-			response, err := stream.Recv()
+	window := make(chan struct{}, *bidiWindow)
+	var mu sync.Mutex
+	sent := map[string]time.Time{}
+	go func() {
+		defer stream.CloseSend()
+		for i := 0; i < 10; i++ {
+			select {
+			case window <- struct{}{}:
+			case <-stream.Context().Done():
+				return
+			}
+			id := fmt.Sprintf("%v", i)
+			mu.Lock()
+			sent[id] = time.Now()
+			mu.Unlock()
+			err := stream.Send(&pb.InferenceRequest{
+				Prompt:    fmt.Sprintf("%v", (i * i)),
+				RequestId: id,
+			})
 			if err != nil {
-				log.Printf("Error in receiving request in BiDirectional client %v", err)
+				log.Printf("Error in Sending request in BiDirectional client %v", err)
+				return
 			}
-			log.Printf("BiDi Received %v", response.GetResult())
 		}
-		time.Sleep(250 * time.Millisecond)
+	}()
+
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("Error in receiving request in BiDirectional client %v", err)
+			return
+		}
+		<-window
+		mu.Lock()
+		start := sent[response.GetRequestId()]
+		mu.Unlock()
+		log.Printf("BiDi Received %v for request %s after %v", response.GetResult(), response.GetRequestId(), time.Since(start))
 	}
 }
 
@@ -167,3 +272,12 @@ func testAll(client pb.ScorerClient, ctx context.Context) {
 	go testServerStreaming(client, ctx)
 	testBiDirectionStreaming(client, ctx)
 }
+
+// modelVersion formats the model and version the server reported serving a call.
+func modelVersion(header metadata.MD) string {
+	model, version := header.Get("x-model"), header.Get("x-model-version")
+	if len(model) == 0 || len(version) == 0 {
+		return "unknown model version"
+	}
+	return model[0] + "/" + version[0]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"azuremachinelearning.com/scorer/compression"
+	"google.golang.org/grpc"
+)
+
+var compressorFlag = flag.String("compression", "", "Compress requests with gzip, zstd or snappy; the server answers in kind")
+
+// callCompressor is the compressor for the next calls; the interactive prompt
+// can change it between tests.
+var callCompressor atomic.Value
+
+func setCompressor(name string) error {
+	if name == "none" {
+		name = ""
+	}
+	if name != "" {
+		known := false
+		for _, registered := range compression.Names() {
+			known = known || registered == name
+		}
+		if !known {
+			return fmt.Errorf("unknown compressor %q, expected one of %v or none", name, compression.Names())
+		}
+	}
+	callCompressor.Store(name)
+	return nil
+}
+
+func compressionOption() []grpc.CallOption {
+	if name, _ := callCompressor.Load().(string); name != "" {
+		return []grpc.CallOption{grpc.UseCompressor(name)}
+	}
+	return nil
+}
+
+func compressionUnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(ctx, method, req, reply, cc, append(opts, compressionOption()...)...)
+}
+
+func compressionStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(ctx, desc, cc, method, append(opts, compressionOption()...)...)
+}
+
+// logCompression reports the bytes saved so far by the current compressor.
+func logCompression() {
+	name, _ := callCompressor.Load().(string)
+	if name == "" {
+		return
+	}
+	stats := compression.Snapshot()[name]
+	log.Printf("Compression %s: sent %d bytes as %d (ratio %.2f) and %d small messages uncompressed, received %d bytes as %d",
+		name, stats.UncompressedBytes, stats.CompressedBytes, stats.Ratio, stats.Stored, stats.DecompressedBytes, stats.ReceivedBytes)
+}
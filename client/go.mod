@@ -5,6 +5,8 @@ go 1.16
 replace azuremachinelearning.com/scorer => ../contract
 
 require (
-	azuremachinelearning.com/scorer v0.0.0-00010101000000-000000000000 // indirect
-	google.golang.org/grpc v1.40.0 // indirect
+	azuremachinelearning.com/scorer v0.0.0-00010101000000-000000000000
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.25.0
 )
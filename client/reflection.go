@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// reflectionClient resolves service and message descriptors from the server
+// reflection service, so calls can be built without compiled stubs.
+type reflectionClient struct {
+	stream rpb.ServerReflection_ServerReflectionInfoClient
+	files  map[string]*descriptorpb.FileDescriptorProto
+}
+
+func newReflectionClient(ctx context.Context, conn *grpc.ClientConn) (*reflectionClient, error) {
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &reflectionClient{stream: stream, files: map[string]*descriptorpb.FileDescriptorProto{}}, nil
+}
+
+func (c *reflectionClient) request(request *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+	if err := c.stream.Send(request); err != nil {
+		return nil, err
+	}
+	response, err := c.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if errorResponse := response.GetErrorResponse(); errorResponse != nil {
+		return nil, fmt.Errorf("reflection error %d: %s", errorResponse.GetErrorCode(), errorResponse.GetErrorMessage())
+	}
+	return response, nil
+}
+
+func (c *reflectionClient) listServices() ([]string, error) {
+	response, err := c.request(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	for _, service := range response.GetListServicesResponse().GetService() {
+		services = append(services, service.GetName())
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// resolve returns the descriptor of a fully qualified symbol, fetching the file
+// defining it and every file it depends on.
+func (c *reflectionClient) resolve(symbol string) (protoreflect.Descriptor, error) {
+	response, err := c.request(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.addFiles(response); err != nil {
+		return nil, err
+	}
+	for _, file := range c.files {
+		for _, dependency := range file.GetDependency() {
+			if err := c.fetchFile(dependency); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, file := range c.files {
+		set.File = append(set.File, file)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	return files.FindDescriptorByName(protoreflect.FullName(symbol))
+}
+
+func (c *reflectionClient) fetchFile(name string) error {
+	if _, ok := c.files[name]; ok {
+		return nil
+	}
+	response, err := c.request(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: name},
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.addFiles(response); err != nil {
+		return err
+	}
+	for _, dependency := range c.files[name].GetDependency() {
+		if err := c.fetchFile(dependency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *reflectionClient) addFiles(response *rpb.ServerReflectionResponse) error {
+	for _, encoded := range response.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		file := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(encoded, file); err != nil {
+			return err
+		}
+		c.files[file.GetName()] = file
+	}
+	return nil
+}
+
+// runReflectionCommand handles the list, describe, invoke and replay
+// subcommands.
+func runReflectionCommand(conn *grpc.ClientConn, command string, args []string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reflection, err := newReflectionClient(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "list":
+		if len(args) == 0 {
+			services, err := reflection.listServices()
+			if err != nil {
+				return err
+			}
+			fmt.Println(strings.Join(services, "\n"))
+			return nil
+		}
+		service, err := resolveService(reflection, args[0])
+		if err != nil {
+			return err
+		}
+		methods := service.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			fmt.Println(methods.Get(i).FullName())
+		}
+		return nil
+	case "describe":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: describe <fully qualified symbol>")
+		}
+		descriptor, err := reflection.resolve(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Print(describeDescriptor(descriptor))
+		return nil
+	case "invoke":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: invoke <service>/<method> [json body]")
+		}
+		body := "{}"
+		if len(args) == 2 {
+			body = args[1]
+		}
+		return invoke(ctx, conn, reflection, args[0], body)
+	case "replay":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: replay <capture.jsonl>...")
+		}
+		return replay(ctx, conn, reflection, args)
+	}
+	return fmt.Errorf("unknown command %s", command)
+}
+
+func resolveService(reflection *reflectionClient, name string) (protoreflect.ServiceDescriptor, error) {
+	descriptor, err := reflection.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	service, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", name)
+	}
+	return service, nil
+}
+
+// describeDescriptor renders a service, message or enum as proto source.
+func describeDescriptor(descriptor protoreflect.Descriptor) string {
+	var out strings.Builder
+	switch d := descriptor.(type) {
+	case protoreflect.ServiceDescriptor:
+		fmt.Fprintf(&out, "service %s {\n", d.FullName())
+		for i := 0; i < d.Methods().Len(); i++ {
+			method := d.Methods().Get(i)
+			fmt.Fprintf(&out, "  rpc %s(%s%s) returns (%s%s);\n", method.Name(),
+				streamPrefix(method.IsStreamingClient()), method.Input().FullName(),
+				streamPrefix(method.IsStreamingServer()), method.Output().FullName())
+		}
+		out.WriteString("}\n")
+	case protoreflect.MethodDescriptor:
+		fmt.Fprintf(&out, "rpc %s(%s%s) returns (%s%s);\n", d.FullName(),
+			streamPrefix(d.IsStreamingClient()), d.Input().FullName(),
+			streamPrefix(d.IsStreamingServer()), d.Output().FullName())
+	case protoreflect.MessageDescriptor:
+		fmt.Fprintf(&out, "message %s {\n", d.FullName())
+		for i := 0; i < d.Fields().Len(); i++ {
+			field := d.Fields().Get(i)
+			fmt.Fprintf(&out, "  %s%s %s = %d;\n", fieldLabel(field), fieldType(field), field.Name(), field.Number())
+		}
+		out.WriteString("}\n")
+	case protoreflect.EnumDescriptor:
+		fmt.Fprintf(&out, "enum %s {\n", d.FullName())
+		for i := 0; i < d.Values().Len(); i++ {
+			value := d.Values().Get(i)
+			fmt.Fprintf(&out, "  %s = %d;\n", value.Name(), value.Number())
+		}
+		out.WriteString("}\n")
+	default:
+		fmt.Fprintf(&out, "%s\n", descriptor.FullName())
+	}
+	return out.String()
+}
+
+func streamPrefix(streaming bool) string {
+	if streaming {
+		return "stream "
+	}
+	return ""
+}
+
+func fieldLabel(field protoreflect.FieldDescriptor) string {
+	if field.IsList() {
+		return "repeated "
+	}
+	return ""
+}
+
+func fieldType(field protoreflect.FieldDescriptor) string {
+	switch {
+	case field.IsMap():
+		return fmt.Sprintf("map<%s, %s>", fieldType(field.MapKey()), fieldType(field.MapValue()))
+	case field.Message() != nil:
+		return string(field.Message().FullName())
+	case field.Enum() != nil:
+		return string(field.Enum().FullName())
+	}
+	return field.Kind().String()
+}
+
+// resolveMethod finds a method given as <service>/<method>, with or without
+// a leading slash.
+func resolveMethod(reflection *reflectionClient, method string) (protoreflect.MethodDescriptor, error) {
+	method = strings.TrimPrefix(method, "/")
+	separator := strings.LastIndexAny(method, "/.")
+	if separator < 0 {
+		return nil, fmt.Errorf("method %s must be <service>/<method>", method)
+	}
+	service, err := resolveService(reflection, method[:separator])
+	if err != nil {
+		return nil, err
+	}
+	descriptor := service.Methods().ByName(protoreflect.Name(method[separator+1:]))
+	if descriptor == nil {
+		return nil, fmt.Errorf("service %s has no method %s", service.FullName(), method[separator+1:])
+	}
+	return descriptor, nil
+}
+
+func fullMethod(descriptor protoreflect.MethodDescriptor) string {
+	return fmt.Sprintf("/%s/%s", descriptor.Parent().FullName(), descriptor.Name())
+}
+
+func streamDesc(descriptor protoreflect.MethodDescriptor) *grpc.StreamDesc {
+	return &grpc.StreamDesc{
+		StreamName:    string(descriptor.Name()),
+		ClientStreams: descriptor.IsStreamingClient(),
+		ServerStreams: descriptor.IsStreamingServer(),
+	}
+}
+
+// invoke calls any method with a JSON request body. Client streaming methods
+// take a JSON array and send one message per element.
+func invoke(ctx context.Context, conn *grpc.ClientConn, reflection *reflectionClient, method, body string) error {
+	descriptor, err := resolveMethod(reflection, method)
+	if err != nil {
+		return err
+	}
+
+	var bodies []json.RawMessage
+	if descriptor.IsStreamingClient() && strings.HasPrefix(strings.TrimSpace(body), "[") {
+		if err := json.Unmarshal([]byte(body), &bodies); err != nil {
+			return err
+		}
+	} else {
+		bodies = []json.RawMessage{json.RawMessage(body)}
+	}
+	var requests []proto.Message
+	for _, body := range bodies {
+		request := dynamicpb.NewMessage(descriptor.Input())
+		if err := protojson.Unmarshal(body, request); err != nil {
+			return fmt.Errorf("parsing request for %s: %v", descriptor.Input().FullName(), err)
+		}
+		requests = append(requests, request)
+	}
+
+	stream, err := conn.NewStream(ctx, streamDesc(descriptor), fullMethod(descriptor))
+	if err != nil {
+		return err
+	}
+	for _, request := range requests {
+		if err := stream.SendMsg(request); err != nil {
+			return err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	if header, err := stream.Header(); err == nil && len(header) > 0 {
+		log.Printf("Response headers %v", header)
+	}
+	for {
+		response := dynamicpb.NewMessage(descriptor.Output())
+		err := stream.RecvMsg(response)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		output, err := protojson.MarshalOptions{Multiline: true}.Marshal(response)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"azuremachinelearning.com/scorer/capture"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var replaySpeed = flag.Float64("replay-speed", 1, "How many times faster than recorded a capture is replayed")
+
+// replayedCall is the outcome of replaying one recorded call.
+type replayedCall struct {
+	record *capture.Record
+	diffs  []string
+}
+
+// replay reproduces the calls of server recordings, rotated files included,
+// starting each at its recorded offset so concurrent calls overlap as they
+// did, and reports the responses that differ from the recorded ones.
+func replay(ctx context.Context, conn *grpc.ClientConn, reflection *reflectionClient, paths []string) error {
+	if *replaySpeed <= 0 {
+		return fmt.Errorf("-replay-speed must be positive")
+	}
+	var records []*capture.Record
+	for _, path := range paths {
+		read, err := capture.Read(path)
+		if err != nil {
+			return err
+		}
+		records = append(records, read...)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no recorded calls in %s", strings.Join(paths, ", "))
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Start.Before(records[j].Start) })
+
+	// The reflection stream is not safe for concurrent use, so every method
+	// is resolved before the calls start.
+	methods := map[string]protoreflect.MethodDescriptor{}
+	for _, record := range records {
+		if methods[record.Method] != nil {
+			continue
+		}
+		descriptor, err := resolveMethod(reflection, record.Method)
+		if err != nil {
+			return err
+		}
+		methods[record.Method] = descriptor
+	}
+
+	begin := time.Now()
+	results := make([]replayedCall, len(records))
+	var wg sync.WaitGroup
+	for i, record := range records {
+		time.Sleep(time.Until(begin.Add(scaled(record.Start.Sub(records[0].Start)))))
+		wg.Add(1)
+		go func(i int, record *capture.Record) {
+			defer wg.Done()
+			results[i] = replayedCall{record: record, diffs: replayCall(ctx, conn, methods[record.Method], record)}
+		}(i, record)
+	}
+	wg.Wait()
+
+	differed := 0
+	for _, result := range results {
+		if len(result.diffs) == 0 {
+			continue
+		}
+		differed++
+		fmt.Printf("%s %s differs:\n", result.record.Method, result.record.ID)
+		for _, diff := range result.diffs {
+			fmt.Printf("  %s\n", diff)
+		}
+	}
+	fmt.Printf("Replayed %d calls in %v: %d matched, %d differed\n", len(results), time.Since(begin).Round(time.Millisecond), len(results)-differed, differed)
+	if differed > 0 {
+		return fmt.Errorf("%d of %d replayed calls differed", differed, len(results))
+	}
+	return nil
+}
+
+func scaled(offset time.Duration) time.Duration {
+	return time.Duration(float64(offset) / *replaySpeed)
+}
+
+// replayCall sends a call's recorded requests at their recorded offsets while
+// receiving its responses, and returns how the outcome differs.
+func replayCall(ctx context.Context, conn *grpc.ClientConn, descriptor protoreflect.MethodDescriptor, record *capture.Record) []string {
+	var requests []proto.Message
+	var offsets []time.Duration
+	for i, message := range record.Messages {
+		if message.Direction != capture.Request {
+			continue
+		}
+		request := dynamicpb.NewMessage(descriptor.Input())
+		if err := protojson.Unmarshal(message.Message, request); err != nil {
+			return []string{fmt.Sprintf("message %d cannot be replayed: %v", i+1, err)}
+		}
+		requests = append(requests, request)
+		offsets = append(offsets, message.Offset)
+	}
+
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(ctx, replayedMetadata(record.Metadata)))
+	defer cancel()
+	start := time.Now()
+	stream, err := conn.NewStream(ctx, streamDesc(descriptor), record.Method)
+	var responses []proto.Message
+	if err == nil {
+		go func() {
+			for i, request := range requests {
+				time.Sleep(time.Until(start.Add(scaled(offsets[i]))))
+				if stream.SendMsg(request) != nil {
+					return
+				}
+			}
+			stream.CloseSend()
+		}()
+		for {
+			response := dynamicpb.NewMessage(descriptor.Output())
+			if err = stream.RecvMsg(response); err != nil {
+				break
+			}
+			responses = append(responses, response)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	return diffResponses(record, responses, status.Code(err).String())
+}
+
+// replayedMetadata drops transport keys and redacted values from recorded
+// metadata.
+func replayedMetadata(recorded map[string][]string) metadata.MD {
+	md := metadata.MD{}
+	for key, values := range recorded {
+		switch {
+		case strings.HasPrefix(key, ":"), strings.HasPrefix(key, "grpc-"),
+			key == "content-type", key == "user-agent", key == "te":
+			continue
+		}
+		if len(values) == 1 && values[0] == capture.Redacted {
+			continue
+		}
+		md[key] = values
+	}
+	return md
+}
+
+// diffResponses compares replayed responses with the recorded ones. Fields
+// redacted in the recording are not compared, and responses are matched by
+// request_id where present because full-duplex calls answer out of order.
+func diffResponses(record *capture.Record, responses []proto.Message, code string) []string {
+	var diffs []string
+	if code != record.Code {
+		diffs = append(diffs, fmt.Sprintf("status %s, recorded %s", code, record.Code))
+	}
+
+	var want, got []map[string]interface{}
+	for _, message := range record.Messages {
+		if message.Direction != capture.Response {
+			continue
+		}
+		fields := map[string]interface{}{}
+		json.Unmarshal(message.Message, &fields)
+		want = append(want, fields)
+	}
+	for _, response := range responses {
+		fields := map[string]interface{}{}
+		data, _ := protojson.MarshalOptions{UseProtoNames: true}.Marshal(response)
+		json.Unmarshal(data, &fields)
+		got = append(got, fields)
+	}
+	byRequestID := func(messages []map[string]interface{}) {
+		sort.SliceStable(messages, func(i, j int) bool {
+			return fmt.Sprint(messages[i]["request_id"]) < fmt.Sprint(messages[j]["request_id"])
+		})
+	}
+	byRequestID(want)
+	byRequestID(got)
+
+	if len(got) != len(want) {
+		diffs = append(diffs, fmt.Sprintf("%d responses, recorded %d", len(got), len(want)))
+	}
+	for i := 0; i < len(want) && i < len(got); i++ {
+		for name, value := range want[i] {
+			if value == capture.Redacted {
+				got[i][name] = value
+			}
+		}
+		if !reflect.DeepEqual(want[i], got[i]) {
+			gotJSON, _ := json.Marshal(got[i])
+			wantJSON, _ := json.Marshal(want[i])
+			diffs = append(diffs, fmt.Sprintf("response %d: %s, recorded %s", i+1, gotJSON, wantJSON))
+		}
+	}
+	return diffs
+}
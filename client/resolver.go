@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	staticScheme = "static"
+	fileScheme   = "file"
+)
+
+var endpointsPollInterval = flag.Duration("endpoints-poll-interval", 5*time.Second, "How often a file:// endpoint list is reread")
+
+// priorityKey is the address attribute holding an endpoint's priority group;
+// lower groups are preferred and higher groups only serve as failover.
+type priorityKey struct{}
+
+func addressPriority(address resolver.Address) int {
+	if address.Attributes == nil {
+		return 0
+	}
+	priority, _ := address.Attributes.Value(priorityKey{}).(int)
+	return priority
+}
+
+func init() {
+	resolver.Register(&endpointsResolverBuilder{scheme: staticScheme})
+	resolver.Register(&endpointsResolverBuilder{scheme: fileScheme})
+}
+
+// dialTarget turns the -addr flag into a gRPC target. A comma separated list
+// of endpoints is balanced as one group; semicolons separate priority groups,
+// e.g. "a:5001,b:5001;backup:5001". dns:/// and file:// targets pass through.
+func dialTarget(address string) string {
+	if strings.Contains(address, "://") {
+		return address
+	}
+	if strings.ContainsAny(address, ",;") {
+		return staticScheme + ":///" + address
+	}
+	return address
+}
+
+// parseStaticEndpoints parses the priority groups of a static target.
+func parseStaticEndpoints(endpoints string) []resolver.Address {
+	var addresses []resolver.Address
+	for priority, group := range strings.Split(endpoints, ";") {
+		for _, endpoint := range strings.Split(group, ",") {
+			if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+				addresses = append(addresses, endpointAddress(endpoint, priority))
+			}
+		}
+	}
+	return addresses
+}
+
+// parseEndpointFile parses one endpoint per line with an optional priority
+// group, e.g. "backup:5001 1". Blank lines and # comments are ignored.
+func parseEndpointFile(data []byte) ([]resolver.Address, error) {
+	var addresses []resolver.Address
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = strings.TrimSpace(text[:i])
+		}
+		fields := strings.Fields(text)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			addresses = append(addresses, endpointAddress(fields[0], 0))
+		case 2:
+			priority, err := strconv.Atoi(fields[1])
+			if err != nil || priority < 0 {
+				return nil, fmt.Errorf("line %d: invalid priority %q", line, fields[1])
+			}
+			addresses = append(addresses, endpointAddress(fields[0], priority))
+		default:
+			return nil, fmt.Errorf("line %d: expected \"host:port [priority]\"", line)
+		}
+	}
+	return addresses, scanner.Err()
+}
+
+func endpointAddress(endpoint string, priority int) resolver.Address {
+	return resolver.Address{Addr: endpoint, Attributes: attributes.New(priorityKey{}, priority)}
+}
+
+type endpointsResolverBuilder struct {
+	scheme string
+}
+
+func (b *endpointsResolverBuilder) Scheme() string { return b.scheme }
+
+func (b *endpointsResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	r := &endpointsResolver{cc: cc, done: make(chan struct{})}
+	if b.scheme == staticScheme {
+		addresses := parseStaticEndpoints(target.Endpoint)
+		if len(addresses) == 0 {
+			return nil, fmt.Errorf("no endpoints in %q", target.Endpoint)
+		}
+		return r, cc.UpdateState(resolver.State{Addresses: addresses})
+	}
+
+	r.path = "/" + strings.TrimPrefix(target.Endpoint, "/")
+	if target.Authority != "" {
+		r.path = target.Authority + r.path
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	go r.watch(*endpointsPollInterval)
+	return r, nil
+}
+
+// endpointsResolver serves a static endpoint list, or one read from a file
+// that is polled for changes.
+type endpointsResolver struct {
+	cc        resolver.ClientConn
+	path      string
+	last      []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *endpointsResolver) reload() error {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(data, r.last) {
+		return nil
+	}
+	addresses, err := parseEndpointFile(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", r.path, err)
+	}
+	r.last = data
+	log.Printf("Endpoints from %s: %v", r.path, addressList(addresses))
+	return r.cc.UpdateState(resolver.State{Addresses: addresses})
+}
+
+func (r *endpointsResolver) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			if err := r.reload(); err != nil {
+				log.Printf("Could not reload endpoints: %v", err)
+				r.cc.ReportError(err)
+			}
+		}
+	}
+}
+
+func (r *endpointsResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *endpointsResolver) Close() {
+	r.closeOnce.Do(func() { close(r.done) })
+}
+
+func addressList(addresses []resolver.Address) []string {
+	var list []string
+	for _, address := range addresses {
+		list = append(list, fmt.Sprintf("%s(p%d)", address.Addr, addressPriority(address)))
+	}
+	return list
+}
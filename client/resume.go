@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const streamSessionHeader = "x-stream-session"
+
+var resumeAttempts = flag.Int("resume-attempts", 5, "Times in a row an interrupted server stream is resumed before giving up, 0 disables resuming")
+
+// responseStream is what StreamingResponseScore and its resume call return.
+type responseStream interface {
+	Recv() (*pb.InferenceResponse, error)
+	grpc.ClientStream
+}
+
+// resumableStream reads a StreamingResponseScore stream and, when the
+// connection drops midway, resumes the server session after the last message
+// received, so callers see one uninterrupted stream.
+type resumableStream struct {
+	ctx      context.Context
+	client   pb.ScorerClient
+	stream   responseStream
+	header   metadata.MD
+	session  string
+	last     int64
+	attempts int
+}
+
+func streamingResponseScore(ctx context.Context, client pb.ScorerClient, request *pb.InferenceRequest, opts ...grpc.CallOption) (*resumableStream, error) {
+	stream, err := client.StreamingResponseScore(ctx, request, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s := &resumableStream{ctx: ctx, client: client, stream: stream}
+	if header, err := stream.Header(); err == nil {
+		s.header = header
+		if session := header.Get(streamSessionHeader); len(session) > 0 {
+			s.session = session[0]
+		}
+	}
+	return s, nil
+}
+
+// Header returns the headers of the original stream.
+func (s *resumableStream) Header() metadata.MD {
+	return s.header
+}
+
+func (s *resumableStream) Recv() (*pb.InferenceResponse, error) {
+	for {
+		response, err := s.stream.Recv()
+		if err == nil {
+			if response.GetSequence() > 0 && response.GetSequence() <= s.last {
+				continue
+			}
+			s.last = response.GetSequence()
+			s.attempts = 0
+			return response, nil
+		}
+		if err == io.EOF {
+			return nil, err
+		}
+		if err = s.resume(err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// resume reopens the session after err interrupted the stream, retrying
+// while the connection stays down.
+func (s *resumableStream) resume(err error) error {
+	for s.resumable(err) {
+		s.attempts++
+		log.Printf("Stream interrupted after sequence %d (%s), resuming session %s", s.last, status.Code(err), s.session)
+		select {
+		case <-s.ctx.Done():
+			return err
+		case <-time.After(time.Duration(s.attempts) * 100 * time.Millisecond):
+		}
+		var stream responseStream
+		stream, err = s.client.ResumeStreamingResponseScore(s.ctx, &pb.ResumeRequest{
+			SessionId:    s.session,
+			LastSequence: s.last,
+		})
+		if err == nil {
+			s.stream = stream
+			return nil
+		}
+	}
+	return err
+}
+
+// resumable reports whether err is a dropped connection worth resuming.
+func (s *resumableStream) resumable(err error) bool {
+	return s.session != "" && s.attempts < *resumeAttempts && s.ctx.Err() == nil && status.Code(err) == codes.Unavailable
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// maxCallAttempts caps retry and hedging attempts as the gRPC spec does.
+	maxCallAttempts = 5
+	pushbackTrailer = "grpc-retry-pushback-ms"
+)
+
+var serviceConfigPath = flag.String("service-config", "", "gRPC service config JSON file with methodConfig retryPolicy or hedgingPolicy and retryThrottling")
+
+// defaultServiceConfig retries Score when no endpoint is reachable, with a
+// retry budget so an outage does not turn into a retry storm.
+const defaultServiceConfig = `{
+  "methodConfig": [{
+    "name": [{"service": "scorer.Scorer", "method": "Score"}],
+    "retryPolicy": {
+      "maxAttempts": 3,
+      "initialBackoff": "0.1s",
+      "maxBackoff": "1s",
+      "backoffMultiplier": 2,
+      "retryableStatusCodes": ["UNAVAILABLE"]
+    }
+  }],
+  "retryThrottling": {"maxTokens": 10, "tokenRatio": 0.1}
+}`
+
+// The service config fields below follow the gRPC service config schema.
+// grpc-go does not hedge and only retries behind GRPC_GO_RETRY, so unary
+// calls are retried and hedged by callPolicies instead.
+type serviceConfigJSON struct {
+	MethodConfig []struct {
+		Name []struct {
+			Service string `json:"service"`
+			Method  string `json:"method"`
+		} `json:"name"`
+		RetryPolicy   *retryPolicyJSON   `json:"retryPolicy"`
+		HedgingPolicy *hedgingPolicyJSON `json:"hedgingPolicy"`
+	} `json:"methodConfig"`
+	RetryThrottling *struct {
+		MaxTokens  float64 `json:"maxTokens"`
+		TokenRatio float64 `json:"tokenRatio"`
+	} `json:"retryThrottling"`
+}
+
+type retryPolicyJSON struct {
+	MaxAttempts          int          `json:"maxAttempts"`
+	InitialBackoff       string       `json:"initialBackoff"`
+	MaxBackoff           string       `json:"maxBackoff"`
+	BackoffMultiplier    float64      `json:"backoffMultiplier"`
+	RetryableStatusCodes []codes.Code `json:"retryableStatusCodes"`
+}
+
+type hedgingPolicyJSON struct {
+	MaxAttempts         int          `json:"maxAttempts"`
+	HedgingDelay        string       `json:"hedgingDelay"`
+	NonFatalStatusCodes []codes.Code `json:"nonFatalStatusCodes"`
+}
+
+type retryPolicy struct {
+	maxAttempts       int
+	initialBackoff    time.Duration
+	maxBackoff        time.Duration
+	backoffMultiplier float64
+	retryable         map[codes.Code]bool
+}
+
+type hedgingPolicy struct {
+	maxAttempts int
+	delay       time.Duration
+	nonFatal    map[codes.Code]bool
+}
+
+// callPolicies holds the retry and hedging policy of each method, keyed by
+// "/service/method" or "/service/" for a whole service.
+type callPolicies struct {
+	retry    map[string]*retryPolicy
+	hedging  map[string]*hedgingPolicy
+	throttle *retryThrottler
+}
+
+// loadServiceConfig reads -service-config, or returns the default policy.
+func loadServiceConfig() ([]byte, error) {
+	if *serviceConfigPath == "" {
+		return []byte(defaultServiceConfig), nil
+	}
+	return ioutil.ReadFile(*serviceConfigPath)
+}
+
+func parseCallPolicies(data []byte) (*callPolicies, error) {
+	var config serviceConfigJSON
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	policies := &callPolicies{retry: map[string]*retryPolicy{}, hedging: map[string]*hedgingPolicy{}}
+	for _, method := range config.MethodConfig {
+		if method.RetryPolicy != nil && method.HedgingPolicy != nil {
+			return nil, fmt.Errorf("methodConfig cannot set both retryPolicy and hedgingPolicy")
+		}
+		var retry *retryPolicy
+		var hedging *hedgingPolicy
+		var err error
+		if method.RetryPolicy != nil {
+			if retry, err = parseRetryPolicy(method.RetryPolicy); err != nil {
+				return nil, err
+			}
+		}
+		if method.HedgingPolicy != nil {
+			if hedging, err = parseHedgingPolicy(method.HedgingPolicy); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range method.Name {
+			key := "/" + name.Service + "/" + name.Method
+			if retry != nil {
+				policies.retry[key] = retry
+			}
+			if hedging != nil {
+				policies.hedging[key] = hedging
+			}
+		}
+	}
+	if throttling := config.RetryThrottling; throttling != nil {
+		if throttling.MaxTokens <= 0 || throttling.MaxTokens > 1000 || throttling.TokenRatio <= 0 {
+			return nil, fmt.Errorf("retryThrottling needs 0 < maxTokens <= 1000 and tokenRatio > 0")
+		}
+		policies.throttle = &retryThrottler{max: throttling.MaxTokens, ratio: throttling.TokenRatio, tokens: throttling.MaxTokens}
+	}
+	return policies, nil
+}
+
+func parseRetryPolicy(config *retryPolicyJSON) (*retryPolicy, error) {
+	initial, err := time.ParseDuration(config.InitialBackoff)
+	if err != nil || initial <= 0 {
+		return nil, fmt.Errorf("retryPolicy: invalid initialBackoff %q", config.InitialBackoff)
+	}
+	max, err := time.ParseDuration(config.MaxBackoff)
+	if err != nil || max <= 0 {
+		return nil, fmt.Errorf("retryPolicy: invalid maxBackoff %q", config.MaxBackoff)
+	}
+	if config.MaxAttempts <= 1 || config.BackoffMultiplier <= 0 || len(config.RetryableStatusCodes) == 0 {
+		return nil, fmt.Errorf("retryPolicy needs maxAttempts > 1, backoffMultiplier > 0 and retryableStatusCodes")
+	}
+	policy := &retryPolicy{
+		maxAttempts:       minInt(config.MaxAttempts, maxCallAttempts),
+		initialBackoff:    initial,
+		maxBackoff:        max,
+		backoffMultiplier: config.BackoffMultiplier,
+		retryable:         map[codes.Code]bool{},
+	}
+	for _, code := range config.RetryableStatusCodes {
+		policy.retryable[code] = true
+	}
+	return policy, nil
+}
+
+func parseHedgingPolicy(config *hedgingPolicyJSON) (*hedgingPolicy, error) {
+	var delay time.Duration
+	if config.HedgingDelay != "" {
+		var err error
+		if delay, err = time.ParseDuration(config.HedgingDelay); err != nil || delay < 0 {
+			return nil, fmt.Errorf("hedgingPolicy: invalid hedgingDelay %q", config.HedgingDelay)
+		}
+	}
+	if config.MaxAttempts <= 1 {
+		return nil, fmt.Errorf("hedgingPolicy needs maxAttempts > 1")
+	}
+	policy := &hedgingPolicy{maxAttempts: minInt(config.MaxAttempts, maxCallAttempts), delay: delay, nonFatal: map[codes.Code]bool{}}
+	for _, code := range config.NonFatalStatusCodes {
+		policy.nonFatal[code] = true
+	}
+	return policy, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// retryThrottler is the gRPC retry budget: failures spend a token, successes
+// earn tokenRatio back, and retries or hedges stop while the bucket is at or
+// below half full.
+type retryThrottler struct {
+	mu     sync.Mutex
+	max    float64
+	ratio  float64
+	tokens float64
+}
+
+func (t *retryThrottler) allow() bool {
+	if t == nil {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tokens > t.max/2
+}
+
+func (t *retryThrottler) record(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err == nil {
+		t.tokens = math.Min(t.max, t.tokens+t.ratio)
+	} else {
+		t.tokens = math.Max(0, t.tokens-1)
+	}
+}
+
+func (p *callPolicies) lookup(method string) (*retryPolicy, *hedgingPolicy) {
+	service := method[:strings.LastIndex(method, "/")+1]
+	if retry, ok := p.retry[method]; ok {
+		return retry, nil
+	}
+	if hedging, ok := p.hedging[method]; ok {
+		return nil, hedging
+	}
+	return p.retry[service], p.hedging[service]
+}
+
+// attemptsOption reports how many attempts a call took.
+type attemptsOption struct {
+	grpc.EmptyCallOption
+	attempts *int
+}
+
+// callAttempts returns a call option that stores the number of attempts made.
+func callAttempts(attempts *int) grpc.CallOption {
+	return attemptsOption{attempts: attempts}
+}
+
+// unaryInterceptor applies the method's retry or hedging policy. Only unary
+// methods are covered; streams are never replayed. Calls rejected by open
+// circuit breakers fail fast and are not retried.
+func (p *callPolicies) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	retry, hedging := p.lookup(method)
+	var attempts int
+	var err error
+	switch {
+	case hedging != nil:
+		attempts, err = p.hedge(ctx, hedging, method, req, reply, cc, invoker, opts)
+	case retry != nil:
+		attempts, err = p.retryCall(ctx, retry, method, req, reply, cc, invoker, opts)
+	default:
+		attempts, err = 1, invoker(ctx, method, req, reply, cc, opts...)
+	}
+	for _, opt := range opts {
+		if o, ok := opt.(attemptsOption); ok {
+			*o.attempts = attempts
+		}
+	}
+	return err
+}
+
+func (p *callPolicies) retryCall(ctx context.Context, policy *retryPolicy, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts []grpc.CallOption) (int, error) {
+	backoff := float64(policy.initialBackoff)
+	for attempt := 1; ; attempt++ {
+		var trailer metadata.MD
+		err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Trailer(&trailer))...)
+		p.throttle.record(err)
+		if err == nil || attempt >= policy.maxAttempts || !policy.retryable[status.Code(err)] || isCircuitOpen(err) || !p.throttle.allow() {
+			return attempt, err
+		}
+
+		// The server may ask for a specific delay, or a negative one to stop.
+		delay := time.Duration(rand.Int63n(int64(backoff) + 1))
+		if pushback := trailer.Get(pushbackTrailer); len(pushback) > 0 {
+			ms, parseErr := strconv.Atoi(pushback[0])
+			if parseErr != nil || ms < 0 {
+				return attempt, err
+			}
+			delay = time.Duration(ms) * time.Millisecond
+		}
+		backoff = math.Min(backoff*policy.backoffMultiplier, float64(policy.maxBackoff))
+		log.Printf("%s attempt %d failed with %s, retrying in %v", method, attempt, status.Code(err), delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+		if m, ok := reply.(proto.Message); ok {
+			proto.Reset(m)
+		}
+	}
+}
+
+type hedgeResult struct {
+	reply   proto.Message
+	header  metadata.MD
+	trailer metadata.MD
+	err     error
+}
+
+// hedge sends the call again every hedgingDelay, or as soon as an attempt
+// fails with a non-fatal code, until one attempt succeeds or fails fatally.
+// The first such result wins and the other attempts are cancelled.
+func (p *callPolicies) hedge(ctx context.Context, policy *hedgingPolicy, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts []grpc.CallOption) (int, error) {
+	replyMessage, ok := reply.(proto.Message)
+	if !ok {
+		return 1, invoker(ctx, method, req, reply, cc, opts...)
+	}
+	// Header and trailer options are rebound per attempt so concurrent
+	// attempts do not write to the caller's metadata.
+	var callerOpts []grpc.CallOption
+	var headerAddr, trailerAddr *metadata.MD
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case grpc.HeaderCallOption:
+			headerAddr = o.HeaderAddr
+		case grpc.TrailerCallOption:
+			trailerAddr = o.TrailerAddr
+		default:
+			callerOpts = append(callerOpts, opt)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan hedgeResult, policy.maxAttempts)
+	launch := func() {
+		result := hedgeResult{reply: proto.Clone(replyMessage)}
+		proto.Reset(result.reply)
+		attemptOpts := append(callerOpts, grpc.Header(&result.header), grpc.Trailer(&result.trailer))
+		go func() {
+			result.err = invoker(ctx, method, req, result.reply, cc, attemptOpts...)
+			results <- result
+		}()
+	}
+
+	launch()
+	attempts, pending := 1, 1
+	timer := time.NewTimer(policy.delay)
+	defer timer.Stop()
+	var last hedgeResult
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if attempts < policy.maxAttempts && p.throttle.allow() {
+				launch()
+				attempts++
+				pending++
+				timer.Reset(policy.delay)
+			}
+			continue
+		case last = <-results:
+			pending--
+		}
+		p.throttle.record(last.err)
+		if last.err == nil || !policy.nonFatal[status.Code(last.err)] || isCircuitOpen(last.err) {
+			break
+		}
+		if attempts < policy.maxAttempts && p.throttle.allow() {
+			log.Printf("%s hedge failed with %s, sending another", method, status.Code(last.err))
+			launch()
+			attempts++
+			pending++
+		}
+	}
+
+	if headerAddr != nil {
+		*headerAddr = last.header
+	}
+	if trailerAddr != nil {
+		*trailerAddr = last.trailer
+	}
+	if last.err == nil {
+		proto.Merge(replyMessage, last.reply)
+	}
+	return attempts, last.err
+}
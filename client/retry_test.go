@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"math"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// setFlags overrides flag values for the duration of a test.
+func setFlags(t *testing.T, values map[string]string) {
+	for name, value := range values {
+		name, previous := name, flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { flag.Set(name, previous) })
+	}
+}
+
+func TestRetryThrottler(t *testing.T) {
+	tests := []struct {
+		name string
+		// outcomes lists the calls recorded in order: f for a failure, s for
+		// a success.
+		outcomes string
+		tokens   float64
+		allow    bool
+	}{
+		{name: "starts full", tokens: 10, allow: true},
+		{name: "failures spend a token", outcomes: "ffff", tokens: 6, allow: true},
+		{name: "stops at half", outcomes: "fffff", tokens: 5, allow: false},
+		{name: "successes earn the ratio", outcomes: "fffff" + strings.Repeat("s", 10), tokens: 6, allow: true},
+		{name: "never below zero", outcomes: strings.Repeat("f", 15), tokens: 0, allow: false},
+		{name: "never above max", outcomes: "sss", tokens: 10, allow: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			throttler := &retryThrottler{max: 10, ratio: 0.1, tokens: 10}
+			for _, outcome := range test.outcomes {
+				var err error
+				if outcome == 'f' {
+					err = status.Error(codes.Unavailable, "down")
+				}
+				throttler.record(err)
+			}
+			if math.Abs(throttler.tokens-test.tokens) > 1e-9 || throttler.allow() != test.allow {
+				t.Errorf("Got %v tokens and allow %v, want %v and %v", throttler.tokens, throttler.allow(), test.tokens, test.allow)
+			}
+		})
+	}
+
+	var unset *retryThrottler
+	unset.record(status.Error(codes.Unavailable, "down"))
+	if !unset.allow() {
+		t.Error("A config without retryThrottling throttled a retry")
+	}
+}
+
+// TestRetryBudget runs calls in order through the retry interceptor, which
+// stops retrying once the shared budget is at half.
+func TestRetryBudget(t *testing.T) {
+	policies, err := parseCallPolicies([]byte(`{
+  "methodConfig": [{
+    "name": [{"service": "scorer.Scorer", "method": "Score"}],
+    "retryPolicy": {
+      "maxAttempts": 5,
+      "initialBackoff": "0.001s",
+      "maxBackoff": "0.001s",
+      "backoffMultiplier": 1,
+      "retryableStatusCodes": ["UNAVAILABLE"]
+    }
+  }],
+  "retryThrottling": {"maxTokens": 4, "tokenRatio": 1}
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		code     codes.Code
+		attempts int
+		tokens   float64
+	}{
+		{name: "retries while over half", code: codes.Unavailable, attempts: 2, tokens: 2},
+		{name: "budget at half", code: codes.Unavailable, attempts: 1, tokens: 1},
+		{name: "success earns a token", code: codes.OK, attempts: 1, tokens: 2},
+		{name: "another success", code: codes.OK, attempts: 1, tokens: 3},
+		{name: "one failure spends the rest", code: codes.Unavailable, attempts: 1, tokens: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempts := 0
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				attempts++
+				return status.Error(test.code, "")
+			}
+			err := policies.unaryInterceptor(context.Background(), "/scorer.Scorer/Score", nil, nil, nil, invoker)
+			if status.Code(err) != test.code || attempts != test.attempts || policies.throttle.tokens != test.tokens {
+				t.Errorf("Got %s after %d attempts with %v tokens, want %s after %d with %v",
+					status.Code(err), attempts, policies.throttle.tokens, test.code, test.attempts, test.tokens)
+			}
+		})
+	}
+}
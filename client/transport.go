@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// HTTP/2 transport tuning. Keepalive pings must not be more frequent than the
+// server's -keepalive-min-time or the server closes the connection.
+var (
+	keepaliveTime          = flag.Duration("keepalive-time", 30*time.Second, "Ping the server after this long without activity, 0 disables")
+	keepaliveTimeout       = flag.Duration("keepalive-timeout", 10*time.Second, "Consider the connection dead when a ping is not acknowledged in time")
+	keepaliveWithoutStream = flag.Bool("keepalive-permit-without-stream", true, "Send pings even when no RPCs are active")
+	initialWindowSize      = flag.Int("initial-window-size", 0, "Per-stream HTTP/2 flow control window in bytes, at least 64KiB")
+	initialConnWindowSize  = flag.Int("initial-conn-window-size", 0, "Per-connection HTTP/2 flow control window in bytes, at least 64KiB")
+	readBufferSize         = flag.Int("read-buffer-size", 0, "Transport read buffer size in bytes")
+	writeBufferSize        = flag.Int("write-buffer-size", 0, "Transport write buffer size in bytes")
+)
+
+// dialOptions builds the transport dial options from the flags.
+func dialOptions() []grpc.DialOption {
+	var options []grpc.DialOption
+	if *keepaliveTime > 0 {
+		options = append(options, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                *keepaliveTime,
+			Timeout:             *keepaliveTimeout,
+			PermitWithoutStream: *keepaliveWithoutStream,
+		}))
+	}
+	if *initialWindowSize > 0 {
+		options = append(options, grpc.WithInitialWindowSize(int32(*initialWindowSize)))
+	}
+	if *initialConnWindowSize > 0 {
+		options = append(options, grpc.WithInitialConnWindowSize(int32(*initialConnWindowSize)))
+	}
+	if *readBufferSize > 0 {
+		options = append(options, grpc.WithReadBufferSize(*readBufferSize))
+	}
+	if *writeBufferSize > 0 {
+		options = append(options, grpc.WithWriteBufferSize(*writeBufferSize))
+	}
+	return options
+}
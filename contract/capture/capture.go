@@ -0,0 +1,152 @@
+// Package capture defines the JSON Lines format the scorer server records
+// RPCs in and the client replays them from. Each line is one Record written
+// when its call finishes.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message directions, from the server's point of view.
+const (
+	Request  = "request"
+	Response = "response"
+)
+
+// Redacted replaces recorded values that must not leave the server.
+const Redacted = "[REDACTED]"
+
+// Record is one recorded call.
+type Record struct {
+	ID       string              `json:"id"`
+	Method   string              `json:"method"`
+	Start    time.Time           `json:"start"`
+	Duration time.Duration       `json:"duration_ns"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+	Header   map[string][]string `json:"header,omitempty"`
+	Messages []Message           `json:"messages"`
+	Code     string              `json:"code"`
+	Error    string              `json:"error,omitempty"`
+}
+
+// Message is a request or response in protobuf JSON, with its offset from
+// the start of the call.
+type Message struct {
+	Direction string          `json:"direction"`
+	Offset    time.Duration   `json:"offset_ns"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// Writer appends records to a file, rotating it once it reaches maxBytes
+// and keeping the newest maxFiles rotated files beside it.
+type Writer struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func NewWriter(path string, maxBytes int64, maxFiles int) (*Writer, error) {
+	w := &Writer{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.size = file, info.Size()
+	return nil
+}
+
+// Write appends a record, reporting whether the file was rotated first.
+func (w *Writer) Write(record *Record) (bool, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rotated := false
+	if w.size > 0 && w.size+int64(len(line)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return false, err
+		}
+		rotated = true
+	}
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	return rotated, err
+}
+
+// rotate renames the current file with a timestamp and starts a new one.
+// The caller holds the mutex.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(w.path)
+	base := strings.TrimSuffix(w.path, ext)
+	rotated := fmt.Sprintf("%s-%s%s", base, time.Now().UTC().Format("20060102T150405.000000"), ext)
+	if err := os.Rename(w.path, rotated); err != nil {
+		return err
+	}
+	if old, err := filepath.Glob(base + "-*" + ext); err == nil && len(old) > w.maxFiles {
+		sort.Strings(old)
+		for _, path := range old[:len(old)-w.maxFiles] {
+			os.Remove(path)
+		}
+	}
+	return w.open()
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// Read loads every record of a capture file.
+func Read(path string) ([]*Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []*Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
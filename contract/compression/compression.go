@@ -0,0 +1,287 @@
+// Package compression registers the gzip, zstd and snappy gRPC compressors
+// used by the scorer server and client, and counts the bytes each one saves.
+//
+// Messages smaller than the minimum size are still framed in the negotiated
+// encoding, so any peer can decode them, but are written at the encoder's
+// cheapest level: stored for gzip and snappy, fastest for zstd.
+package compression
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+)
+
+const (
+	Gzip   = "gzip"
+	Zstd   = "zstd"
+	Snappy = "snappy"
+)
+
+var minSize int64
+
+// SetMinSize sets the smallest message, in bytes, that is compressed.
+func SetMinSize(bytes int) {
+	atomic.StoreInt64(&minSize, int64(bytes))
+}
+
+// Stats counts the messages a compressor sent and received.
+type Stats struct {
+	Messages          int64   `json:"messages"`
+	Stored            int64   `json:"stored"`
+	StoredBytes       int64   `json:"stored_bytes"`
+	UncompressedBytes int64   `json:"uncompressed_bytes"`
+	CompressedBytes   int64   `json:"compressed_bytes"`
+	Ratio             float64 `json:"ratio"`
+	ReceivedMessages  int64   `json:"received_messages"`
+	ReceivedBytes     int64   `json:"received_bytes"`
+	DecompressedBytes int64   `json:"decompressed_bytes"`
+}
+
+type compressor struct {
+	name       string
+	compress   func(w io.Writer, data []byte) error
+	store      func(w io.Writer, data []byte) error
+	decompress func(r io.Reader) (io.Reader, error)
+
+	messages, stored, storedBytes, uncompressed, compressed int64
+	receivedMessages, received, decompressed                int64
+}
+
+var compressors []*compressor
+
+func init() {
+	register(&compressor{name: Gzip, compress: compressGzip, store: storeGzip, decompress: decompressGzip})
+	register(&compressor{name: Zstd, compress: compressZstd, store: storeZstd, decompress: decompressZstd})
+	register(&compressor{name: Snappy, compress: compressSnappy, store: storeSnappy, decompress: decompressSnappy})
+}
+
+func register(c *compressor) {
+	compressors = append(compressors, c)
+	encoding.RegisterCompressor(c)
+}
+
+// Names lists the registered compressors.
+func Names() []string {
+	var names []string
+	for _, c := range compressors {
+		names = append(names, c.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Snapshot returns the counters of every compressor by name. Messages below
+// the size policy are counted in Stored and StoredBytes only, so Ratio is the
+// uncompressed size of the messages that were compressed over their
+// compressed size.
+func Snapshot() map[string]Stats {
+	snapshot := map[string]Stats{}
+	for _, c := range compressors {
+		stats := Stats{
+			Messages:          atomic.LoadInt64(&c.messages),
+			Stored:            atomic.LoadInt64(&c.stored),
+			StoredBytes:       atomic.LoadInt64(&c.storedBytes),
+			UncompressedBytes: atomic.LoadInt64(&c.uncompressed),
+			CompressedBytes:   atomic.LoadInt64(&c.compressed),
+			ReceivedMessages:  atomic.LoadInt64(&c.receivedMessages),
+			ReceivedBytes:     atomic.LoadInt64(&c.received),
+			DecompressedBytes: atomic.LoadInt64(&c.decompressed),
+		}
+		if stats.CompressedBytes > 0 {
+			stats.Ratio = float64(stats.UncompressedBytes) / float64(stats.CompressedBytes)
+		}
+		snapshot[c.name] = stats
+	}
+	return snapshot
+}
+
+func (c *compressor) Name() string { return c.name }
+
+// Compress buffers the message so the size policy can be applied on Close.
+func (c *compressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return &messageWriter{compressor: c, w: w}, nil
+}
+
+func (c *compressor) Decompress(r io.Reader) (io.Reader, error) {
+	atomic.AddInt64(&c.receivedMessages, 1)
+	reader, err := c.decompress(&countingReader{r: r, count: &c.received})
+	if err != nil {
+		return nil, err
+	}
+	return &countingReader{r: reader, count: &c.decompressed}, nil
+}
+
+type messageWriter struct {
+	*compressor
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (m *messageWriter) Write(p []byte) (int, error) {
+	return m.buf.Write(p)
+}
+
+func (m *messageWriter) Close() error {
+	data := m.buf.Bytes()
+	out := &countingWriter{w: m.w}
+	if int64(len(data)) < atomic.LoadInt64(&minSize) {
+		if err := m.store(out, data); err != nil {
+			return err
+		}
+		atomic.AddInt64(&m.messages, 1)
+		atomic.AddInt64(&m.stored, 1)
+		atomic.AddInt64(&m.storedBytes, out.n)
+		return nil
+	}
+	if err := m.compress(out, data); err != nil {
+		return err
+	}
+	atomic.AddInt64(&m.messages, 1)
+	atomic.AddInt64(&m.uncompressed, int64(len(data)))
+	atomic.AddInt64(&m.compressed, out.n)
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r     io.Reader
+	count *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.count, int64(n))
+	return n, err
+}
+
+var (
+	gzipWriters      = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	gzipStoreWriters = sync.Pool{New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.NoCompression)
+		return w
+	}}
+)
+
+func compressGzip(w io.Writer, data []byte) error {
+	return writeGzip(&gzipWriters, w, data)
+}
+
+// storeGzip writes deflate stored blocks.
+func storeGzip(w io.Writer, data []byte) error {
+	return writeGzip(&gzipStoreWriters, w, data)
+}
+
+func writeGzip(pool *sync.Pool, w io.Writer, data []byte) error {
+	gw := pool.Get().(*gzip.Writer)
+	defer pool.Put(gw)
+	gw.Reset(w)
+	if _, err := gw.Write(data); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func decompressGzip(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// The zstd encoders are shared; EncodeAll is safe for concurrent use.
+var (
+	zstdEncoder, _        = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdFastestEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedFastest))
+)
+
+func compressZstd(w io.Writer, data []byte) error {
+	_, err := w.Write(zstdEncoder.EncodeAll(data, nil))
+	return err
+}
+
+// storeZstd encodes at the fastest level, which zstd has instead of a stored
+// mode.
+func storeZstd(w io.Writer, data []byte) error {
+	_, err := w.Write(zstdFastestEncoder.EncodeAll(data, nil))
+	return err
+}
+
+var zstdDecoders = sync.Pool{New: func() interface{} {
+	decoder, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	return decoder
+}}
+
+func decompressZstd(r io.Reader) (io.Reader, error) {
+	decoder := zstdDecoders.Get().(*zstd.Decoder)
+	if err := decoder.Reset(r); err != nil {
+		zstdDecoders.Put(decoder)
+		return nil, err
+	}
+	return &zstdReader{decoder: decoder}, nil
+}
+
+// zstdReader returns its decoder to the pool once the message is read.
+type zstdReader struct {
+	decoder *zstd.Decoder
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	if z.decoder == nil {
+		return 0, io.EOF
+	}
+	n, err := z.decoder.Read(p)
+	if err != nil {
+		z.decoder.Reset(nil)
+		zstdDecoders.Put(z.decoder)
+		z.decoder = nil
+	}
+	return n, err
+}
+
+// Snappy messages are written by the s2 encoder in its snappy-compatible mode.
+var (
+	snappyWriters = sync.Pool{New: func() interface{} {
+		return s2.NewWriter(nil, s2.WriterSnappyCompat(), s2.WriterConcurrency(1))
+	}}
+	snappyStoreWriters = sync.Pool{New: func() interface{} {
+		return s2.NewWriter(nil, s2.WriterSnappyCompat(), s2.WriterConcurrency(1), s2.WriterUncompressed())
+	}}
+)
+
+func compressSnappy(w io.Writer, data []byte) error {
+	return writeSnappy(&snappyWriters, w, data)
+}
+
+// storeSnappy writes uncompressed chunks.
+func storeSnappy(w io.Writer, data []byte) error {
+	return writeSnappy(&snappyStoreWriters, w, data)
+}
+
+func writeSnappy(pool *sync.Pool, w io.Writer, data []byte) error {
+	sw := pool.Get().(*s2.Writer)
+	defer pool.Put(sw)
+	sw.Reset(w)
+	if _, err := sw.Write(data); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+func decompressSnappy(r io.Reader) (io.Reader, error) {
+	return s2.NewReader(r), nil
+}
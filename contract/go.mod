@@ -3,6 +3,7 @@ module azuremachinelearning.com/scorer
 go 1.16
 
 require (
-	google.golang.org/grpc v1.40.0 // indirect
-	google.golang.org/protobuf v1.25.0 // indirect
+	github.com/klauspost/compress v1.15.9
+	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.25.0
 )
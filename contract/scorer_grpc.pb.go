@@ -22,6 +22,7 @@ type ScorerClient interface {
 	StreamingRequestScore(ctx context.Context, opts ...grpc.CallOption) (Scorer_StreamingRequestScoreClient, error)
 	StreamingResponseScore(ctx context.Context, in *InferenceRequest, opts ...grpc.CallOption) (Scorer_StreamingResponseScoreClient, error)
 	BidirectionalScore(ctx context.Context, opts ...grpc.CallOption) (Scorer_BidirectionalScoreClient, error)
+	ResumeStreamingResponseScore(ctx context.Context, in *ResumeRequest, opts ...grpc.CallOption) (Scorer_ResumeStreamingResponseScoreClient, error)
 }
 
 type scorerClient struct {
@@ -138,6 +139,38 @@ func (x *scorerBidirectionalScoreClient) Recv() (*InferenceResponse, error) {
 	return m, nil
 }
 
+func (c *scorerClient) ResumeStreamingResponseScore(ctx context.Context, in *ResumeRequest, opts ...grpc.CallOption) (Scorer_ResumeStreamingResponseScoreClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Scorer_ServiceDesc.Streams[3], "/scorer.Scorer/ResumeStreamingResponseScore", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &scorerResumeStreamingResponseScoreClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Scorer_ResumeStreamingResponseScoreClient interface {
+	Recv() (*InferenceResponse, error)
+	grpc.ClientStream
+}
+
+type scorerResumeStreamingResponseScoreClient struct {
+	grpc.ClientStream
+}
+
+func (x *scorerResumeStreamingResponseScoreClient) Recv() (*InferenceResponse, error) {
+	m := new(InferenceResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // ScorerServer is the server API for Scorer service.
 // All implementations must embed UnimplementedScorerServer
 // for forward compatibility
@@ -146,6 +179,7 @@ type ScorerServer interface {
 	StreamingRequestScore(Scorer_StreamingRequestScoreServer) error
 	StreamingResponseScore(*InferenceRequest, Scorer_StreamingResponseScoreServer) error
 	BidirectionalScore(Scorer_BidirectionalScoreServer) error
+	ResumeStreamingResponseScore(*ResumeRequest, Scorer_ResumeStreamingResponseScoreServer) error
 	mustEmbedUnimplementedScorerServer()
 }
 
@@ -165,6 +199,9 @@ func (UnimplementedScorerServer) StreamingResponseScore(*InferenceRequest, Score
 func (UnimplementedScorerServer) BidirectionalScore(Scorer_BidirectionalScoreServer) error {
 	return status.Errorf(codes.Unimplemented, "method BidirectionalScore not implemented")
 }
+func (UnimplementedScorerServer) ResumeStreamingResponseScore(*ResumeRequest, Scorer_ResumeStreamingResponseScoreServer) error {
+	return status.Errorf(codes.Unimplemented, "method ResumeStreamingResponseScore not implemented")
+}
 func (UnimplementedScorerServer) mustEmbedUnimplementedScorerServer() {}
 
 // UnsafeScorerServer may be embedded to opt out of forward compatibility for this service.
@@ -269,6 +306,27 @@ func (x *scorerBidirectionalScoreServer) Recv() (*InferenceRequest, error) {
 	return m, nil
 }
 
+func _Scorer_ResumeStreamingResponseScore_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ResumeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ScorerServer).ResumeStreamingResponseScore(m, &scorerResumeStreamingResponseScoreServer{stream})
+}
+
+type Scorer_ResumeStreamingResponseScoreServer interface {
+	Send(*InferenceResponse) error
+	grpc.ServerStream
+}
+
+type scorerResumeStreamingResponseScoreServer struct {
+	grpc.ServerStream
+}
+
+func (x *scorerResumeStreamingResponseScoreServer) Send(m *InferenceResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // Scorer_ServiceDesc is the grpc.ServiceDesc for Scorer service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -298,6 +356,11 @@ var Scorer_ServiceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "ResumeStreamingResponseScore",
+			Handler:       _Scorer_ResumeStreamingResponseScore_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "contract/scorer.proto",
 }
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc"
+	channelz "google.golang.org/grpc/channelz/service"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	adminListenAddress = flag.String("admin-listen", "", "Address of the admin API, e.g. localhost:5002, empty disables it")
+	adminToken         = flag.String("admin-token", "", "Bearer token the admin API requires, empty allows any caller that can reach it")
+	adminTokenFile     = flag.String("admin-token-file", "", "File holding the admin token, which keeps it off the command line")
+)
+
+// activeCall is a gRPC call in flight, as listed by the admin API.
+type activeCall struct {
+	ID        string    `json:"id"`
+	Method    string    `json:"method"`
+	Kind      string    `json:"kind"`
+	Peer      string    `json:"peer"`
+	Tenant    string    `json:"tenant,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	Started   time.Time `json:"started"`
+	Age       string    `json:"age"`
+
+	cancel    context.CancelFunc
+	cancelled bool
+	// onCancel is guarded by the tracker's mutex.
+	onCancel []func()
+}
+
+// callHandle finds a call's tracker entry from its context.
+type callHandle struct {
+	tracker *callTracker
+	call    *activeCall
+}
+
+type callKey struct{}
+
+// callTracker keeps the gRPC calls in flight so operators can list and cancel
+// them, and rejects new calls while the server drains. Health checks and
+// reflection keep working during a drain so load balancers see it.
+type callTracker struct {
+	mu       sync.Mutex
+	calls    map[string]*activeCall
+	next     int64
+	draining bool
+	hooks    []func(draining bool)
+}
+
+func newCallTracker() *callTracker {
+	return &callTracker{calls: map[string]*activeCall{}}
+}
+
+func (c *callTracker) unaryInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, done, err := c.start(ctx, info.FullMethod, "unary")
+	if err != nil {
+		return nil, err
+	}
+	response, err := handler(ctx, request)
+	return response, done(err)
+}
+
+func (c *callTracker) streamInterceptor(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	kind := "bidi_stream"
+	if !info.IsClientStream {
+		kind = "server_stream"
+	} else if !info.IsServerStream {
+		kind = "client_stream"
+	}
+	ctx, done, err := c.start(stream.Context(), info.FullMethod, kind)
+	if err != nil {
+		return err
+	}
+	return done(handler(server, &sessionStream{ServerStream: stream, ctx: ctx}))
+}
+
+// start registers a call with a context the admin API can cancel. The call
+// must be finished with its result, which done reports as Canceled if an
+// operator cancelled the call.
+func (c *callTracker) start(ctx context.Context, method, kind string) (context.Context, func(error) error, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	call := &activeCall{
+		Method:    method,
+		Kind:      kind,
+		Tenant:    firstValue(md, tenantHeader),
+		RequestID: firstValue(md, requestIDHeader),
+		Started:   time.Now(),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		call.Peer = p.Addr.String()
+	}
+	ctx, call.cancel = context.WithCancel(ctx)
+	ctx = context.WithValue(ctx, callKey{}, callHandle{tracker: c, call: call})
+
+	c.mu.Lock()
+	if c.draining && !strings.HasPrefix(method, "/grpc.") {
+		c.mu.Unlock()
+		call.cancel()
+		return nil, nil, status.Error(codes.Unavailable, "server is draining")
+	}
+	c.next++
+	call.ID = strconv.FormatInt(c.next, 10)
+	c.calls[call.ID] = call
+	c.mu.Unlock()
+
+	return ctx, func(err error) error {
+		call.cancel()
+		c.mu.Lock()
+		delete(c.calls, call.ID)
+		cancelled := call.cancelled
+		c.mu.Unlock()
+		if cancelled && err != nil {
+			return status.Error(codes.Canceled, "call cancelled by an operator")
+		}
+		return err
+	}, nil
+}
+
+// list returns the calls in flight, oldest first.
+func (c *callTracker) list() []activeCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	calls := make([]activeCall, 0, len(c.calls))
+	for _, call := range c.calls {
+		listed := *call
+		listed.Age = time.Since(call.Started).Round(time.Millisecond).String()
+		calls = append(calls, listed)
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].Started.Before(calls[j].Started) })
+	return calls
+}
+
+func (c *callTracker) cancel(id string) bool {
+	c.mu.Lock()
+	call := c.calls[id]
+	var hooks []func()
+	if call != nil {
+		call.cancelled = true
+		hooks = call.onCancel
+	}
+	c.mu.Unlock()
+	if call == nil {
+		return false
+	}
+	infof("Admin cancelled call %s to %s from %s", id, call.Method, call.Peer)
+	call.cancel()
+	for _, hook := range hooks {
+		hook()
+	}
+	return true
+}
+
+// onCancel runs stop if an operator cancels the call ctx belongs to, for work
+// the call started that outlives its context.
+func onCancel(ctx context.Context, stop func()) {
+	handle, ok := ctx.Value(callKey{}).(callHandle)
+	if !ok {
+		return
+	}
+	handle.tracker.mu.Lock()
+	cancelled := handle.call.cancelled
+	if !cancelled {
+		handle.call.onCancel = append(handle.call.onCancel, stop)
+	}
+	handle.tracker.mu.Unlock()
+	if cancelled {
+		stop()
+	}
+}
+
+// drain starts or stops rejecting new calls.
+func (c *callTracker) drain(draining bool) {
+	c.mu.Lock()
+	changed := c.draining != draining
+	c.draining = draining
+	hooks := c.hooks
+	c.mu.Unlock()
+	if !changed {
+		return
+	}
+	infof("Admin set draining to %v", draining)
+	for _, hook := range hooks {
+		hook(draining)
+	}
+}
+
+func (c *callTracker) isDraining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
+// onDrain calls hook whenever draining starts or stops, and now if the
+// server is already draining.
+func (c *callTracker) onDrain(hook func(draining bool)) {
+	c.mu.Lock()
+	c.hooks = append(c.hooks, hook)
+	draining := c.draining
+	c.mu.Unlock()
+	if draining {
+		hook(true)
+	}
+}
+
+// httpHandler fails HTTP requests with 503 while the server drains, health
+// checks included. The metrics stay reachable on the admin listener.
+func (c *callTracker) httpHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.isDraining() {
+			http.Error(w, "server is draining", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminServer is the admin API. It runs on its own listener so that it can
+// stay unreachable from clients of the shared port, and shares it with the
+// runtime diagnostics.
+type adminServer struct {
+	registry *modelRegistry
+	calls    *callTracker
+	reload   func() error
+}
+
+type adminModel struct {
+	modelStatus
+	Config *modelConfig `json:"config,omitempty"`
+}
+
+func adminHandler(registry *modelRegistry, calls *callTracker, reload func() error) http.Handler {
+	a := &adminServer{registry: registry, calls: calls, reload: reload}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/calls", a.listCalls)
+	mux.HandleFunc("/admin/calls/", a.cancelCall)
+	mux.HandleFunc("/admin/models", a.models)
+	mux.HandleFunc("/admin/models/reload", a.reloadModels)
+	mux.HandleFunc("/admin/config", a.config)
+	mux.HandleFunc("/admin/log-level", a.logLevel)
+	mux.HandleFunc("/admin/drain", a.drain)
+	registerDiagnostics(mux)
+	return a.authenticate(mux)
+}
+
+// serveAdmin serves the admin API and the profilers over HTTP/1.1 on the
+// admin listener, and the gRPC channelz service beside them for tools like
+// grpcdebug. It returns once the listener is closed.
+func serveAdmin(listener net.Listener, handler http.Handler) error {
+	tcpmux := cmux.New(listener)
+	httpListener := tcpmux.Match(cmux.HTTP1Fast())
+	grpcListener := tcpmux.MatchWithWriters(cmux.HTTP2MatchHeaderFieldPrefixSendSettings("content-type", "application/grpc"))
+
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(adminUnaryInterceptor),
+		grpc.ChainStreamInterceptor(adminStreamInterceptor),
+	)
+	channelz.RegisterChannelzServiceToServer(grpcServer)
+	reflection.Register(grpcServer)
+	defer grpcServer.Stop()
+	httpServer := &http.Server{Handler: handler}
+	defer httpServer.Close()
+	go httpServer.Serve(httpListener)
+	go grpcServer.Serve(grpcListener)
+
+	return tcpmux.Serve()
+}
+
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validAdminToken(r.Header.Get("Authorization")) {
+			writeAdminError(w, http.StatusUnauthorized, "missing or wrong admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadAdminToken reads -admin-token-file into the admin token.
+func loadAdminToken() error {
+	if *adminTokenFile == "" {
+		return nil
+	}
+	if *adminToken != "" {
+		return fmt.Errorf("set only one of -admin-token and -admin-token-file")
+	}
+	data, err := ioutil.ReadFile(*adminTokenFile)
+	if err != nil {
+		return err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("-admin-token-file %s is empty", *adminTokenFile)
+	}
+	*adminToken = token
+	return nil
+}
+
+// validAdminToken checks an Authorization value against the admin token.
+// Anything passes when no token is set.
+func validAdminToken(authorization string) bool {
+	if *adminToken == "" {
+		return true
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1
+}
+
+// authenticateRPC requires the admin token in the authorization metadata of
+// channelz and reflection calls on the admin port.
+func authenticateRPC(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if !validAdminToken(firstValue(md, "authorization")) {
+		return status.Error(codes.Unauthenticated, "missing or wrong admin token")
+	}
+	return nil
+}
+
+func adminUnaryInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := authenticateRPC(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+func adminStreamInterceptor(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := authenticateRPC(stream.Context()); err != nil {
+		return err
+	}
+	return handler(server, stream)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// allow answers requests with other methods with 405 and reports whether the
+// request may proceed.
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAdminError(w, http.StatusMethodNotAllowed, r.Method+" is not supported")
+	return false
+}
+
+// listCalls answers GET /admin/calls with the gRPC calls in flight.
+func (a *adminServer) listCalls(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.calls.list())
+}
+
+// cancelCall answers DELETE /admin/calls/<id> by cancelling the call, which
+// ends with status Canceled.
+func (a *adminServer) cancelCall(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodDelete) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/admin/calls/")
+	if !a.calls.cancel(id) {
+		writeAdminError(w, http.StatusNotFound, "no call "+id+" in flight")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"cancelled": id})
+}
+
+// models answers GET /admin/models with every model's state and config.
+func (a *adminServer) models(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	var models []adminModel
+	for _, status := range a.registry.list() {
+		listed := adminModel{modelStatus: status}
+		if m := a.registry.get(status.Name); m != nil {
+			listed.Config = &m.config
+		}
+		models = append(models, listed)
+	}
+	writeJSON(w, http.StatusOK, models)
+}
+
+// reloadModels answers POST /admin/models/reload by reloading every model
+// from the model config file and repository, unchanged manifests included.
+// Replaced versions drain as on any reload.
+func (a *adminServer) reloadModels(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	infof("Admin reloading models")
+	if err := a.reload(); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, a.registry.list())
+}
+
+// config answers GET /admin/config with the value of every flag, and the
+// current log level. The admin token is not shown.
+func (a *adminServer) config(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	flags := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = f.Value.String()
+	})
+	if flags["admin-token"] != "" {
+		flags["admin-token"] = "[REDACTED]"
+	}
+	flags["log-level"] = getLogLevel().String()
+	writeJSON(w, http.StatusOK, flags)
+}
+
+// logLevel answers GET /admin/log-level and changes the level on PUT with a
+// body like {"level":"warning"}.
+func (a *adminServer) logLevel(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		level, err := parseLogLevel(body.Level)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		setLogLevel(level)
+		infof("Admin set log level to %s", level)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": getLogLevel().String()})
+}
+
+// drain answers GET /admin/drain with the drain state and the calls still in
+// flight. POST starts draining and DELETE returns to serving.
+func (a *adminServer) drain(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		a.calls.drain(true)
+	case http.MethodDelete:
+		a.calls.drain(false)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"draining":    a.calls.isDraining(),
+		"activeCalls": len(a.calls.list()),
+	})
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+type adminClient struct {
+	t     *testing.T
+	url   string
+	token string
+}
+
+func startAdmin(t *testing.T, server *testServer, reload func() error) *adminClient {
+	admin := httptest.NewServer(adminHandler(server.registry, server.calls, reload))
+	t.Cleanup(admin.Close)
+	return &adminClient{t: t, url: admin.URL}
+}
+
+// do sends an admin request and decodes the JSON answer into out.
+func (c *adminClient) do(method, path, body string, out interface{}) int {
+	c.t.Helper()
+	request, err := http.NewRequest(method, c.url+path, strings.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, _ := ioutil.ReadAll(response.Body)
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			c.t.Fatalf("Could not decode %s %s answer %s: %v", method, path, data, err)
+		}
+	}
+	return response.StatusCode
+}
+
+func TestAdminCancelCall(t *testing.T) {
+	server := startTestServer(t)
+	backend, cancelled := blockingBackend()
+	server.setBackend(t, defaultModelName, backend)
+	admin := startAdmin(t, server, nil)
+
+	stream, err := server.client.StreamingResponseScore(testContext(t), &pb.InferenceRequest{Prompt: "Today is"})
+	checkCode(t, err, codes.OK)
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls []activeCall
+	admin.do(http.MethodGet, "/admin/calls", "", &calls)
+	if len(calls) != 1 || calls[0].Method != "/scorer.Scorer/StreamingResponseScore" || calls[0].Kind != "server_stream" || calls[0].Peer == "" {
+		t.Fatalf("Got calls %+v, want the stream", calls)
+	}
+	if code := admin.do(http.MethodDelete, "/admin/calls/nope", "", nil); code != http.StatusNotFound {
+		t.Errorf("Cancelling an unknown call got %d", code)
+	}
+	if code := admin.do(http.MethodDelete, "/admin/calls/"+calls[0].ID, "", nil); code != http.StatusOK {
+		t.Fatalf("Cancelling the call got %d", code)
+	}
+	_, err = receiveAll(stream)
+	checkCode(t, err, codes.Canceled)
+	<-cancelled
+}
+
+func TestAdminDrain(t *testing.T) {
+	server := startTestServer(t)
+	admin := startAdmin(t, server, nil)
+	health := healthpb.NewHealthClient(server.conn)
+	check := func(want healthpb.HealthCheckResponse_ServingStatus) {
+		t.Helper()
+		response, err := health.Check(testContext(t), &healthpb.HealthCheckRequest{Service: defaultModelName})
+		checkCode(t, err, codes.OK)
+		if response.GetStatus() != want {
+			t.Errorf("Health is %s, want %s", response.GetStatus(), want)
+		}
+	}
+
+	var state struct {
+		Draining bool `json:"draining"`
+	}
+	admin.do(http.MethodPost, "/admin/drain", "", &state)
+	if !state.Draining {
+		t.Error("Not draining after POST")
+	}
+	_, err := server.client.Score(testContext(t), &pb.InferenceRequest{Prompt: "Today is"})
+	checkCode(t, err, codes.Unavailable)
+	check(healthpb.HealthCheckResponse_NOT_SERVING)
+	response, err := http.Get(server.url + "/healthcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("HTTP health check while draining got %d", response.StatusCode)
+	}
+
+	admin.do(http.MethodDelete, "/admin/drain", "", &state)
+	if state.Draining {
+		t.Error("Still draining after DELETE")
+	}
+	_, err = server.client.Score(testContext(t), &pb.InferenceRequest{Prompt: "Today is"})
+	checkCode(t, err, codes.OK)
+	check(healthpb.HealthCheckResponse_SERVING)
+}
+
+func TestAdminModels(t *testing.T) {
+	server := startTestServer(t)
+	reloads := 0
+	var reloadErr error
+	admin := startAdmin(t, server, func() error {
+		reloads++
+		return reloadErr
+	})
+
+	var models []adminModel
+	admin.do(http.MethodGet, "/admin/models", "", &models)
+	if len(models) != 1 || models[0].Name != defaultModelName || models[0].Config == nil || models[0].Config.Versions[0].Weight != 100 {
+		t.Errorf("Got models %+v", models)
+	}
+	if code := admin.do(http.MethodPost, "/admin/models/reload", "", nil); code != http.StatusOK || reloads != 1 {
+		t.Errorf("Reload got %d after %d reloads", code, reloads)
+	}
+	reloadErr = errors.New("bad manifest")
+	if code := admin.do(http.MethodPost, "/admin/models/reload", "", nil); code != http.StatusInternalServerError {
+		t.Errorf("Failed reload got %d", code)
+	}
+	if code := admin.do(http.MethodGet, "/admin/models/reload", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET reload got %d", code)
+	}
+}
+
+func TestReloadKeepsServing(t *testing.T) {
+	server := startTestServer(t)
+	var mu sync.Mutex
+	var states []healthpb.HealthCheckResponse_ServingStatus
+	server.registry.subscribe(func(status modelStatus) {
+		if status.Name == defaultModelName {
+			mu.Lock()
+			states = append(states, servingStatus(status))
+			mu.Unlock()
+		}
+	})
+
+	reloaded := testModel
+	reloaded.Versions = []versionConfig{{Name: "v2", Weight: 100}}
+	if err := server.registry.load(reloaded, ""); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, state := range states {
+		if state != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("Health went through %v during the reload", states)
+			break
+		}
+	}
+	response, err := healthpb.NewHealthClient(server.conn).Check(testContext(t), &healthpb.HealthCheckRequest{Service: defaultModelName})
+	checkCode(t, err, codes.OK)
+	if response.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Health is %s after the reload", response.GetStatus())
+	}
+	version, err := server.registry.route(testContext(t), defaultModelName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer version.release()
+	if version.name != "v2" {
+		t.Errorf("Routed to %s after the reload", version.name)
+	}
+}
+
+func TestAdminReloadModelConfig(t *testing.T) {
+	server := startTestServer(t)
+	path := filepath.Join(t.TempDir(), "models.json")
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin := startAdmin(t, server, func() error { return server.registry.loadModelConfig(path) })
+
+	write(`[{"name":"a","versions":[{"name":"v1","weight":100}]},{"name":"b","versions":[{"name":"v1","weight":100}]}]`)
+	if code := admin.do(http.MethodPost, "/admin/models/reload", "", nil); code != http.StatusOK {
+		t.Fatalf("Reload got %d", code)
+	}
+	write(`[{"name":"a","versions":[{"name":"v1","weight":100}]}]`)
+	if code := admin.do(http.MethodPost, "/admin/models/reload", "", nil); code != http.StatusOK {
+		t.Fatalf("Reload got %d", code)
+	}
+	_, err := server.client.Score(testContext(t), &pb.InferenceRequest{Prompt: "Today is", Model: "b"})
+	checkCode(t, err, codes.NotFound)
+	if server.registry.get("a") == nil || server.registry.get(defaultModelName) == nil {
+		t.Errorf("Reload unloaded models still configured or from another source: %+v", server.registry.list())
+	}
+}
+
+func TestAdminLogLevelAndConfig(t *testing.T) {
+	server := startTestServer(t)
+	admin := startAdmin(t, server, nil)
+	t.Cleanup(func() { setLogLevel(debugLevel) })
+
+	var level map[string]string
+	if code := admin.do(http.MethodPut, "/admin/log-level", `{"level":"warning"}`, &level); code != http.StatusOK || level["level"] != "warning" {
+		t.Errorf("Setting the level got %d %v", code, level)
+	}
+	if getLogLevel() != warningLevel {
+		t.Errorf("Log level is %s", getLogLevel())
+	}
+	if code := admin.do(http.MethodPut, "/admin/log-level", `{"level":"loud"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("Setting an unknown level got %d", code)
+	}
+
+	var config map[string]string
+	admin.do(http.MethodGet, "/admin/config", "", &config)
+	if config["listen"] != ":5001" || config["log-level"] != "warning" {
+		t.Errorf("Got config %v", config)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	setFlag(t, adminToken, "secret")
+	server := startTestServer(t)
+	admin := startAdmin(t, server, nil)
+
+	if code := admin.do(http.MethodGet, "/admin/calls", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("Without a token got %d", code)
+	}
+	admin.token = "wrong"
+	if code := admin.do(http.MethodGet, "/admin/calls", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("With a wrong token got %d", code)
+	}
+	admin.token = "secret"
+	var config map[string]string
+	if code := admin.do(http.MethodGet, "/admin/config", "", &config); code != http.StatusOK || config["admin-token"] != "[REDACTED]" {
+		t.Errorf("With the token got %d, admin-token %q", code, config["admin-token"])
+	}
+	// gRPC on the admin port takes the token as authorization metadata.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveAdmin(listener, adminHandler(server.registry, server.calls, nil))
+	t.Cleanup(func() { listener.Close() })
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	channelzClient := channelzpb.NewChannelzClient(conn)
+	_, err = channelzClient.GetServers(testContext(t), &channelzpb.GetServersRequest{})
+	checkCode(t, err, codes.Unauthenticated)
+	ctx := metadata.AppendToOutgoingContext(testContext(t), "authorization", "Bearer wrong")
+	_, err = channelzClient.GetServers(ctx, &channelzpb.GetServersRequest{})
+	checkCode(t, err, codes.Unauthenticated)
+	ctx = metadata.AppendToOutgoingContext(testContext(t), "authorization", "Bearer secret")
+	_, err = channelzClient.GetServers(ctx, &channelzpb.GetServersRequest{})
+	checkCode(t, err, codes.OK)
+}
+
+func TestAdminTokenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, adminToken, "")
+	setFlag(t, adminTokenFile, path)
+	if err := loadAdminToken(); err != nil || *adminToken != "secret" {
+		t.Fatalf("Got token %q, error %v", *adminToken, err)
+	}
+	if err := loadAdminToken(); err == nil {
+		t.Error("Setting both -admin-token and -admin-token-file was accepted")
+	}
+	setFlag(t, adminToken, "")
+	setFlag(t, adminTokenFile, filepath.Join(t.TempDir(), "missing"))
+	if err := loadAdminToken(); err == nil {
+		t.Error("A missing token file was accepted")
+	}
+}
+
+func TestAdminDiagnostics(t *testing.T) {
+	server := startTestServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveAdmin(listener, adminHandler(server.registry, server.calls, nil))
+	t.Cleanup(func() { listener.Close() })
+	admin := &adminClient{t: t, url: "http://" + listener.Addr().String()}
+
+	if code := admin.do(http.MethodGet, "/debug/pprof/goroutine?debug=1", "", nil); code != http.StatusOK {
+		t.Errorf("pprof got %d", code)
+	}
+	var metrics map[string]json.RawMessage
+	if code := admin.do(http.MethodGet, "/debug/vars", "", &metrics); code != http.StatusOK || metrics["stream_buffers"] == nil || metrics["cmdline"] != nil {
+		t.Errorf("Metrics got %d with %d keys, cmdline %s", code, len(metrics), metrics["cmdline"])
+	}
+	var snapshot runtimeSnapshot
+	admin.do(http.MethodGet, "/admin/snapshot", "", &snapshot)
+	if snapshot.Goroutines == 0 || snapshot.Heap.InUse == 0 || len(snapshot.Stacks) == 0 || len(snapshot.Stacks[0].Frames) == 0 {
+		t.Fatalf("Got snapshot %+v", snapshot)
+	}
+	if frame := snapshot.Stacks[0].Frames[0]; !strings.Contains(frame, ".go:") {
+		t.Errorf("Frame %q has no location", frame)
+	}
+	snapshot = runtimeSnapshot{}
+	admin.do(http.MethodGet, "/admin/snapshot?stacks=false", "", &snapshot)
+	if len(snapshot.Stacks) != 0 {
+		t.Errorf("Got %d stacks with stacks=false", len(snapshot.Stacks))
+	}
+
+	// Channelz shares the admin port over gRPC and sees the test servers.
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	servers, err := channelzpb.NewChannelzClient(conn).GetServers(testContext(t), &channelzpb.GetServersRequest{})
+	checkCode(t, err, codes.OK)
+	if len(servers.GetServer()) == 0 {
+		t.Error("Channelz lists no servers")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+)
+
+// modelBackend produces inference results for a single model version. The
+// generation parameters may be nil.
+type modelBackend interface {
+	Score(ctx context.Context, prompt string, parameters *pb.GenerationParameters) (string, error)
+	StreamScore(ctx context.Context, prompt string, parameters *pb.GenerationParameters, send func(string) error) error
+}
+
+// backendConfig selects and parameterizes the backend serving a version.
+type backendConfig struct {
+	Type     string `json:"type"`
+	Suffix   string `json:"suffix,omitempty"`
+	Chunks   int    `json:"chunks,omitempty"`
+	Interval string `json:"interval,omitempty"`
+
+	// Simulated backends only: unary latency, streaming delays before the
+	// first chunk and between chunks, injected error rates by gRPC code name
+	// such as "UNAVAILABLE", and a seed for reproducible runs.
+	Latency    *latencyConfig     `json:"latency,omitempty"`
+	FirstToken *latencyConfig     `json:"firstToken,omitempty"`
+	InterToken *latencyConfig     `json:"interToken,omitempty"`
+	Errors     map[string]float64 `json:"errors,omitempty"`
+	Seed       int64              `json:"seed,omitempty"`
+}
+
+func newBackend(config backendConfig) (modelBackend, error) {
+	switch config.Type {
+	case "", "echo":
+		backend := &echoBackend{suffix: "sunny", chunks: 10, interval: 250 * time.Millisecond}
+		if config.Suffix != "" {
+			backend.suffix = config.Suffix
+		}
+		if config.Chunks > 0 {
+			backend.chunks = config.Chunks
+		}
+		if config.Interval != "" {
+			interval, err := time.ParseDuration(config.Interval)
+			if err != nil {
+				return nil, fmt.Errorf("invalid interval %q: %v", config.Interval, err)
+			}
+			backend.interval = interval
+		}
+		return backend, nil
+	case "simulated":
+		return newSimulatedBackend(config)
+	default:
+		return nil, fmt.Errorf("unknown backend type %q", config.Type)
+	}
+}
+
+// echoBackend is the demo model: it appends a fixed word to unary prompts and
+// streams the prompt back with a counter. Requests with a temperature get a
+// sampled word instead, and max_tokens cuts both answers short.
+type echoBackend struct {
+	suffix   string
+	chunks   int
+	interval time.Duration
+}
+
+func (b *echoBackend) Score(ctx context.Context, prompt string, parameters *pb.GenerationParameters) (string, error) {
+	return complete(ctx, prompt, b.suffix, parameters), nil
+}
+
+func (b *echoBackend) StreamScore(ctx context.Context, prompt string, parameters *pb.GenerationParameters, send func(string) error) error {
+	sent := 0
+	for i := 0; i < b.chunks; i++ {
+		chunk, spent := limitTokens(ctx, fmt.Sprintf("%s %v", prompt, i), &sent, parameters)
+		if err := send(chunk); err != nil {
+			return err
+		}
+		if spent {
+			if i+1 < b.chunks {
+				markTruncated(ctx)
+			}
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return contextStatus(ctx)
+		case <-time.After(b.interval):
+		}
+	}
+	return nil
+}
+
+// weatherWords are the completions sampled for requests with a temperature.
+var weatherWords = []string{"sunny", "cloudy", "rainy", "windy", "foggy", "snowy"}
+
+// generationRand returns the source a request samples from: seeded by the
+// request so its answer can be reproduced, or random without a seed.
+func generationRand(parameters *pb.GenerationParameters) *rand.Rand {
+	seed := parameters.GetSeed()
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return rand.New(rand.NewSource(seed))
+}
+
+// complete answers a unary prompt: the prompt and suffix, or a sampled word at
+// a non-zero temperature, cut to max_tokens.
+func complete(ctx context.Context, prompt, suffix string, parameters *pb.GenerationParameters) string {
+	if parameters.GetTemperature() > 0 {
+		suffix = weatherWords[generationRand(parameters).Intn(len(weatherWords))]
+	}
+	result, finish := truncateTokens(prompt+" "+suffix, int(parameters.GetMaxTokens()))
+	if finish == "length" {
+		markTruncated(ctx)
+	}
+	return result
+}
+
+// limitTokens cuts a stream chunk to what is left of max_tokens after sent
+// tokens, counts it, and reports whether the budget is spent. A backend that
+// stops early because of it calls markTruncated.
+func limitTokens(ctx context.Context, chunk string, sent *int, parameters *pb.GenerationParameters) (string, bool) {
+	max := int(parameters.GetMaxTokens())
+	if max <= 0 {
+		return chunk, false
+	}
+	chunk, finish := truncateTokens(chunk, max-*sent)
+	if finish == "length" {
+		markTruncated(ctx)
+	}
+	*sent += countTokens(chunk)
+	return chunk, *sent >= max
+}
+
+type truncationKey struct{}
+
+// withTruncation returns a context in which backends report that max_tokens
+// cut their answer short, and a function telling whether one did. Answers go
+// back as plain strings, so this is how the OpenAI API learns its
+// finish_reason.
+func withTruncation(ctx context.Context) (context.Context, func() bool) {
+	truncated := new(int32)
+	return context.WithValue(ctx, truncationKey{}, truncated), func() bool {
+		return atomic.LoadInt32(truncated) == 1
+	}
+}
+
+// markTruncated records that max_tokens cut the answer for ctx short.
+func markTruncated(ctx context.Context) {
+	if truncated, ok := ctx.Value(truncationKey{}).(*int32); ok {
+		atomic.StoreInt32(truncated, 1)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"sync"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// What a full stream buffer does with the next message.
+const (
+	blockPolicy    = "block"
+	coalescePolicy = "coalesce"
+	abortPolicy    = "abort"
+)
+
+var (
+	streamBufferSize   = flag.Int("stream-buffer", 32, "Messages buffered between the backend and a StreamingResponseScore client")
+	streamBufferPolicy = flag.String("stream-buffer-policy", blockPolicy, "What a full stream buffer does: block the backend, coalesce queued messages or abort the stream")
+)
+
+// bufferMetrics reports buffered messages and stalled streams as gauges next
+// to counters of how often each policy applied.
+var bufferMetrics = expvar.NewMap("stream_buffers")
+
+func validBufferPolicy(policy string) bool {
+	return policy == blockPolicy || policy == coalescePolicy || policy == abortPolicy
+}
+
+// streamBuffer sits between a stream's producer and its client. When the
+// client falls behind and the buffer fills, the stream is stalled and the
+// policy decides whether the producer waits, the new message is merged into
+// the last queued one, or the stream fails. Resumable and shared streams apply
+// the same policy in their flightStream instead.
+type streamBuffer struct {
+	mu      sync.Mutex
+	queue   []*pb.InferenceResponse
+	size    int
+	policy  string
+	stalled bool
+	done    bool
+	err     error
+	aborted error
+	ready   chan struct{}
+	space   chan struct{}
+}
+
+// bufferedSend runs produce concurrently with delivering its messages to
+// send, so a slow client is handled by the buffer policy rather than by
+// holding up the producer on every message.
+func bufferedSend(ctx context.Context, produce func(context.Context, func(*pb.InferenceResponse) error) error, send func(*pb.InferenceResponse) error) error {
+	b := &streamBuffer{
+		size:   *streamBufferSize,
+		policy: *streamBufferPolicy,
+		ready:  make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+	}
+	bufferMetrics.Add("streams", 1)
+	ctx, cancel := context.WithCancel(ctx)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		b.finish(produce(ctx, func(response *pb.InferenceResponse) error {
+			return b.push(ctx, response)
+		}))
+	}()
+	defer func() {
+		cancel()
+		<-finished
+		b.release()
+		bufferMetrics.Add("streams", -1)
+	}()
+
+	for {
+		response, err := b.pop(ctx)
+		if response == nil {
+			return err
+		}
+		if err := send(response); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *streamBuffer) push(ctx context.Context, response *pb.InferenceResponse) error {
+	b.mu.Lock()
+	for len(b.queue) >= b.size {
+		b.stall()
+		switch b.policy {
+		case coalescePolicy:
+			// The merged message carries the later sequence, so resuming
+			// after it does not repeat either part.
+			last := b.queue[len(b.queue)-1]
+			last.Result += response.GetResult()
+			last.Sequence = response.GetSequence()
+			b.mu.Unlock()
+			bufferMetrics.Add("coalesced", 1)
+			return nil
+		case abortPolicy:
+			b.aborted = status.Errorf(codes.ResourceExhausted, "client fell %d messages behind the stream", b.size)
+			b.mu.Unlock()
+			bufferMetrics.Add("aborted", 1)
+			signal(b.ready)
+			return b.aborted
+		default:
+			b.mu.Unlock()
+			bufferMetrics.Add("blocked", 1)
+			select {
+			case <-b.space:
+			case <-ctx.Done():
+				return contextStatus(ctx)
+			}
+			b.mu.Lock()
+		}
+	}
+	b.queue = append(b.queue, response)
+	b.mu.Unlock()
+	bufferMetrics.Add("buffered", 1)
+	signal(b.ready)
+	return nil
+}
+
+// pop returns the next message, or nil with the producer's error once the
+// stream ends. An aborted stream ends at once without draining.
+func (b *streamBuffer) pop(ctx context.Context) (*pb.InferenceResponse, error) {
+	for {
+		b.mu.Lock()
+		if b.aborted != nil {
+			b.mu.Unlock()
+			return nil, b.aborted
+		}
+		if len(b.queue) > 0 {
+			response := b.queue[0]
+			b.queue = b.queue[1:]
+			if b.stalled {
+				b.stalled = false
+				bufferMetrics.Add("stalled", -1)
+			}
+			b.mu.Unlock()
+			bufferMetrics.Add("buffered", -1)
+			signal(b.space)
+			return response, nil
+		}
+		if b.done {
+			b.mu.Unlock()
+			return nil, b.err
+		}
+		b.mu.Unlock()
+		select {
+		case <-b.ready:
+		case <-ctx.Done():
+			return nil, contextStatus(ctx)
+		}
+	}
+}
+
+func (b *streamBuffer) finish(err error) {
+	b.mu.Lock()
+	b.done, b.err = true, err
+	b.mu.Unlock()
+	signal(b.ready)
+}
+
+// stall counts the stream as stalled until the client takes a message. The
+// caller holds the mutex.
+func (b *streamBuffer) stall() {
+	if !b.stalled {
+		b.stalled = true
+		bufferMetrics.Add("stalled", 1)
+		bufferMetrics.Add("stalls", 1)
+	}
+}
+
+// release takes an ended stream's leftovers out of the gauges.
+func (b *streamBuffer) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bufferMetrics.Add("buffered", -int64(len(b.queue)))
+	if b.stalled {
+		bufferMetrics.Add("stalled", -1)
+	}
+}
+
+// signal wakes a waiter without blocking when one is already pending.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	cacheControlHeader = "cache-control"
+	cacheStatusHeader  = "x-cache"
+)
+
+var cacheMetrics = expvar.NewMap("response_cache")
+
+// responseCache is an LRU cache of unary results bounded by total size in
+// bytes, with entries expiring after a fixed TTL.
+type responseCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	ttl      time.Duration
+	size     int
+	entries  *list.List
+	index    map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	result  string
+	expires time.Time
+}
+
+func (e *cacheEntry) size() int {
+	return len(e.key) + len(e.result)
+}
+
+func newResponseCache(maxBytes int, ttl time.Duration) *responseCache {
+	return &responseCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  list.New(),
+		index:    map[string]*list.Element{},
+	}
+}
+
+func (c *responseCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.index[key]
+	if !ok {
+		cacheMetrics.Add("misses", 1)
+		return "", false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeLocked(element)
+		cacheMetrics.Add("expired", 1)
+		cacheMetrics.Add("misses", 1)
+		return "", false
+	}
+	c.entries.MoveToFront(element)
+	cacheMetrics.Add("hits", 1)
+	return entry.result, true
+}
+
+func (c *responseCache) put(key, result string) {
+	entry := &cacheEntry{key: key, result: result, expires: time.Now().Add(c.ttl)}
+	if entry.size() > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.index[key]; ok {
+		c.removeLocked(element)
+	}
+	c.index[key] = c.entries.PushFront(entry)
+	c.size += entry.size()
+	for c.size > c.maxBytes {
+		c.removeLocked(c.entries.Back())
+		cacheMetrics.Add("evictions", 1)
+	}
+	c.publishLocked()
+}
+
+func (c *responseCache) removeLocked(element *list.Element) {
+	entry := c.entries.Remove(element).(*cacheEntry)
+	delete(c.index, entry.key)
+	c.size -= entry.size()
+	c.publishLocked()
+}
+
+func (c *responseCache) publishLocked() {
+	size, entries := new(expvar.Int), new(expvar.Int)
+	size.Set(int64(c.size))
+	entries.Set(int64(len(c.index)))
+	cacheMetrics.Set("bytes", size)
+	cacheMetrics.Set("entries", entries)
+}
+
+// requestKey identifies the result of a request for caching and coalescing.
+// Requests that sample non-deterministically have no key and are never shared.
+func requestKey(version *modelVersion, request *pb.InferenceRequest) (string, bool) {
+	parameters := request.GetParameters()
+	if parameters.GetTemperature() != 0 && parameters.GetSeed() == 0 {
+		return "", false
+	}
+	encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(parameters)
+	if err != nil {
+		return "", false
+	}
+	return strings.Join([]string{version.model, version.name, request.GetPrompt(), string(encoded)}, "\x00"), true
+}
+
+// cacheControl reads the caller's cache directives: no-store bypasses the
+// cache entirely, no-cache skips the lookup but refreshes the stored entry.
+func cacheControl(md metadata.MD) (lookup, store bool) {
+	lookup, store = true, true
+	for _, value := range md.Get(cacheControlHeader) {
+		for _, directive := range strings.Split(value, ",") {
+			switch strings.TrimSpace(strings.ToLower(directive)) {
+			case "no-store":
+				lookup, store = false, false
+			case "no-cache":
+				lookup = false
+			}
+		}
+	}
+	return lookup, store
+}
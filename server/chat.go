@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"io"
+	"sync"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	chatTTL         = flag.Duration("chat-ttl", 30*time.Minute, "How long a BidirectionalScore chat session is kept once no stream is attached")
+	chatMaxBytes    = flag.Int("chat-max-bytes", 64<<10, "Size limit of a chat session's history in bytes, beyond which the oldest turns are dropped")
+	chatMaxSessions = flag.Int("chat-max-sessions", 10000, "Number of chat sessions kept at once, 0 disables chat mode")
+)
+
+var chatMetrics = expvar.NewMap("chat_sessions")
+
+// newChatSession is the x-chat-session value that starts a conversation.
+const newChatSession = "new"
+
+const (
+	systemRole    = "system"
+	userRole      = "user"
+	assistantRole = "assistant"
+)
+
+// chatSessions keeps the history of BidirectionalScore conversations so a
+// client can reattach to one on a new stream. A session is forgotten once no
+// stream has been attached to it for the TTL.
+type chatSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*chatSession
+	ttl      time.Duration
+	maxBytes int
+	max      int
+}
+
+type chatSession struct {
+	id     string
+	tenant string
+	// mu serializes turns so the history stays ordered when several streams
+	// are attached.
+	mu      sync.Mutex
+	history []chatMessage
+	size    int
+	turns   int64
+	// attached and expiry are guarded by the sessions mutex.
+	attached int
+	expiry   *time.Timer
+}
+
+func newChatSessions(ttl time.Duration, maxBytes, max int) *chatSessions {
+	return &chatSessions{sessions: map[string]*chatSession{}, ttl: ttl, maxBytes: maxBytes, max: max}
+}
+
+// open attaches a stream to the session named by id, starting a new one when
+// id is newChatSession. The caller must close the session when it detaches.
+func (c *chatSessions) open(ctx context.Context, id string) (*chatSession, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tenant := firstValue(md, tenantHeader)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var session *chatSession
+	if id == newChatSession {
+		if len(c.sessions) >= c.max {
+			return nil, status.Errorf(codes.ResourceExhausted, "too many chat sessions, the limit is %d", c.max)
+		}
+		session = &chatSession{id: newSessionID(), tenant: tenant}
+		c.sessions[session.id] = session
+		chatMetrics.Add("started", 1)
+	} else {
+		session = c.sessions[id]
+		if session == nil || session.tenant != tenant {
+			return nil, status.Errorf(codes.NotFound, "chat session %q is unknown or expired", id)
+		}
+		chatMetrics.Add("reattached", 1)
+	}
+	session.attached++
+	if session.expiry != nil {
+		session.expiry.Stop()
+		session.expiry = nil
+	}
+	return session, nil
+}
+
+// close detaches a stream, arming expiry once the last one has gone.
+func (c *chatSessions) close(session *chatSession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	session.attached--
+	if session.attached == 0 {
+		c.expireLater(session)
+	}
+}
+
+// expireLater drops the session after the TTL unless a stream attaches
+// first. The caller holds the mutex.
+func (c *chatSessions) expireLater(session *chatSession) {
+	var timer *time.Timer
+	timer = time.AfterFunc(c.ttl, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if session.expiry != timer || session.attached > 0 {
+			return
+		}
+		delete(c.sessions, session.id)
+		chatMetrics.Add("expired", 1)
+	})
+	session.expiry = timer
+}
+
+// turn adds a message to the history and, for user messages, generates the
+// assistant reply from the whole conversation. Other roles only extend the
+// history and return a nil response.
+func (c *chatSessions) turn(ctx context.Context, session *chatSession, backend modelBackend, message chatMessage, parameters *pb.GenerationParameters) (*pb.InferenceResponse, error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	// A failed turn restores the history, so a retry neither repeats the
+	// unanswered message nor finds older ones trimmed to make room for it.
+	history, size := append([]chatMessage(nil), session.history...), session.size
+	fail := func(err error) (*pb.InferenceResponse, error) {
+		session.history, session.size = history, size
+		return nil, err
+	}
+	if err := session.add(message, c.maxBytes); err != nil {
+		return fail(err)
+	}
+	if message.Role != userRole {
+		return nil, nil
+	}
+
+	result, err := backend.Score(ctx, chatPrompt(session.history), parameters)
+	if err != nil {
+		return fail(err)
+	}
+	if err := session.add(chatMessage{Role: assistantRole, Content: result}, c.maxBytes); err != nil {
+		return fail(err)
+	}
+	session.turns++
+	chatMetrics.Add("turns", 1)
+	return &pb.InferenceResponse{Result: result, Turn: session.turns}, nil
+}
+
+// add appends a message, dropping the oldest conversation messages while the
+// history is over maxBytes. System messages are never dropped.
+func (s *chatSession) add(message chatMessage, maxBytes int) error {
+	size := messageSize(message)
+	for s.size+size > maxBytes {
+		oldest := -1
+		for i, m := range s.history {
+			if m.Role != systemRole {
+				oldest = i
+				break
+			}
+		}
+		if oldest < 0 {
+			return status.Errorf(codes.ResourceExhausted, "chat message of %d bytes does not fit the %d byte history limit", size, maxBytes)
+		}
+		s.size -= messageSize(s.history[oldest])
+		s.history = append(s.history[:oldest], s.history[oldest+1:]...)
+		chatMetrics.Add("trimmed", 1)
+	}
+	s.history = append(s.history, message)
+	s.size += size
+	return nil
+}
+
+func messageSize(message chatMessage) int {
+	return len(message.Role) + len(message.Content)
+}
+
+// chat runs a BidirectionalScore stream as a conversation, answering each
+// user message in order with the session's history as context.
+func (s *scorerServer) chat(stream pb.Scorer_BidirectionalScoreServer, id string) error {
+	if s.chats == nil {
+		return status.Error(codes.Unimplemented, "chat sessions are disabled")
+	}
+	session, err := s.chats.open(stream.Context(), id)
+	if err != nil {
+		return err
+	}
+	defer s.chats.close(session)
+	if err := stream.SendHeader(metadata.Pairs(chatSessionHeader, session.id)); err != nil {
+		return err
+	}
+	debugf("BiDi Chat session %s attached", session.id)
+
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			debugf("BiDi Chat session %s detached", session.id)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		role := request.GetRole()
+		if role == "" {
+			role = userRole
+		}
+		if role != systemRole && role != userRole && role != assistantRole {
+			return status.Errorf(codes.InvalidArgument, "unknown chat role %q", role)
+		}
+
+		version, err := s.registry.route(stream.Context(), request.GetModel())
+		if err != nil {
+			return err
+		}
+		response, err := s.chats.turn(stream.Context(), session, version.backend, chatMessage{Role: role, Content: request.GetPrompt()}, request.GetParameters())
+		version.release()
+		if err != nil {
+			return err
+		}
+		if response == nil {
+			continue
+		}
+		if err := stream.Send(response); err != nil {
+			return err
+		}
+	}
+}
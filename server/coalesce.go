@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var coalesceMetrics = expvar.NewMap("coalescing")
+
+// flightGroup collapses concurrent unary calls with the same key into a single
+// backend call whose result is shared. The backend call runs on its own
+// context and is only cancelled once every caller waiting on it has gone.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done    chan struct{}
+	result  string
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: map[string]*flightCall{}}
+}
+
+// do runs fn once per key among concurrent callers, reporting whether the
+// result came from another caller's call.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (string, error)) (string, bool, error) {
+	g.mu.Lock()
+	call, shared := g.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.Background())
+		call = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = call
+		go func() {
+			call.result, call.err = fn(callCtx)
+			g.forget(key, call)
+			cancel()
+			close(call.done)
+		}()
+	} else {
+		coalesceMetrics.Add("unary_shared", 1)
+	}
+	call.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.result, shared, call.err
+	case <-ctx.Done():
+		g.leave(key, call)
+		return "", shared, contextStatus(ctx)
+	}
+}
+
+// leave abandons a call, cancelling it when nobody else is waiting so that a
+// later caller starts afresh instead of joining a cancelled call.
+func (g *flightGroup) leave(key string, call *flightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	call.waiters--
+	if call.waiters == 0 {
+		call.cancel()
+		if g.calls[key] == call {
+			delete(g.calls, key)
+		}
+	}
+}
+
+func (g *flightGroup) forget(key string, call *flightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
+
+// streamGroup collapses concurrent server streams with the same key into one
+// backend stream. Callers joining late first receive the chunks generated so
+// far and then follow the live stream.
+type streamGroup struct {
+	mu      sync.Mutex
+	streams map[string]*flightStream
+}
+
+func newStreamGroup() *streamGroup {
+	return &streamGroup{streams: map[string]*flightStream{}}
+}
+
+// stream relays the shared stream for key to send, starting the backend
+// stream with produce when no identical stream is in flight.
+func (g *streamGroup) stream(ctx context.Context, key string, produce func(context.Context, func(string) error) error, send func(string) error) (bool, error) {
+	g.mu.Lock()
+	flight, shared := g.streams[key]
+	if !shared {
+		streamCtx, cancel := context.WithCancel(context.Background())
+		flight = newFlightStream(streamCtx, cancel, 0)
+		g.streams[key] = flight
+		go func() {
+			err := produce(streamCtx, flight.append)
+			g.forget(key, flight)
+			cancel()
+			flight.finish(err)
+		}()
+	} else {
+		coalesceMetrics.Add("stream_shared", 1)
+	}
+	flight.waiters++
+	g.mu.Unlock()
+	defer g.leave(key, flight)
+
+	return shared, flight.follow(ctx, 0, func(chunk string, sequence int64) error {
+		return send(chunk)
+	})
+}
+
+// flightStream holds the messages of a backend stream for its followers and
+// is the stream's buffer: once the furthest follower is size messages behind,
+// or any number while none is following, the buffer policy makes the producer
+// wait, merges the new message into the last one not yet taken, or fails the
+// stream. With maxBytes set, once the messages add up to more than that,
+// those already delivered are dropped, oldest first, and following from
+// before them is no longer possible. When that is not enough the stream
+// fails.
+type flightStream struct {
+	mu       sync.Mutex
+	chunks   []string
+	dropped  int64
+	bytes    int
+	maxBytes int
+	size     int
+	policy   string
+	// delivered counts the messages the furthest follower was sent, read
+	// those it has taken to send.
+	delivered int64
+	read      int64
+	stalled   bool
+	updated   chan struct{}
+	space     chan struct{}
+	done      bool
+	err       error
+	// stopped replaces the producer's error when the stream was stopped.
+	stopped error
+	// waiters is guarded by the group's mutex.
+	waiters int
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func newFlightStream(ctx context.Context, cancel context.CancelFunc, maxBytes int) *flightStream {
+	return &flightStream{
+		maxBytes: maxBytes,
+		size:     *streamBufferSize,
+		policy:   *streamBufferPolicy,
+		updated:  make(chan struct{}),
+		space:    make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// check reports whether a follower can start after the first from messages.
+func (f *flightStream) check(from int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rangeError(from)
+}
+
+// rangeError is check for a caller holding the mutex.
+func (f *flightStream) rangeError(from int64) error {
+	produced := f.dropped + int64(len(f.chunks))
+	if from < 0 || from > produced {
+		return status.Errorf(codes.OutOfRange, "sequence %d is outside the %d messages produced so far", from, produced)
+	}
+	if from < f.dropped {
+		return status.Errorf(codes.OutOfRange, "messages up to sequence %d were dropped from the stream", f.dropped)
+	}
+	return nil
+}
+
+// follow sends the messages after the first from, with their sequence,
+// waiting for new ones until the stream finishes or ctx is done.
+func (f *flightStream) follow(ctx context.Context, from int64, send func(string, int64) error) error {
+	next := from
+	for {
+		f.mu.Lock()
+		if err := f.rangeError(next); err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		// Copied so the producer can merge into the last message.
+		chunks := append([]string(nil), f.chunks[next-f.dropped:]...)
+		updated, done, err := f.updated, f.done, f.err
+		if end := next + int64(len(chunks)); end > f.read {
+			f.read = end
+		}
+		f.mu.Unlock()
+
+		for _, chunk := range chunks {
+			next++
+			if err := send(chunk, next); err != nil {
+				return err
+			}
+			f.deliver(next)
+		}
+		if done {
+			return err
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return contextStatus(ctx)
+		}
+	}
+}
+
+// deliver records that a follower sent the first n messages.
+func (f *flightStream) deliver(n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n <= f.delivered {
+		return
+	}
+	f.delivered = n
+	if f.stalled {
+		f.stalled = false
+		bufferMetrics.Add("stalled", -1)
+	}
+	signal(f.space)
+}
+
+func (f *flightStream) append(chunk string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	merge := false
+	for f.dropped+int64(len(f.chunks))-f.delivered >= int64(f.size) {
+		f.stall()
+		if f.policy == coalescePolicy {
+			// Only a message no follower has taken can grow; when the last
+			// one was taken the new one is queued for the next to merge into.
+			merge = f.dropped+int64(len(f.chunks)) > f.read
+			if merge {
+				bufferMetrics.Add("coalesced", 1)
+			}
+			break
+		}
+		if f.policy == abortPolicy {
+			bufferMetrics.Add("aborted", 1)
+			return status.Errorf(codes.ResourceExhausted, "client fell %d messages behind the stream", f.size)
+		}
+		bufferMetrics.Add("blocked", 1)
+		f.mu.Unlock()
+		select {
+		case <-f.space:
+		case <-f.ctx.Done():
+			f.mu.Lock()
+			return contextStatus(f.ctx)
+		}
+		f.mu.Lock()
+	}
+
+	for f.maxBytes > 0 && len(f.chunks) > 0 && f.dropped < f.delivered && f.bytes+len(chunk) > f.maxBytes {
+		f.bytes -= len(f.chunks[0])
+		f.chunks = f.chunks[1:]
+		f.dropped++
+		sessionMetrics.Add("dropped", 1)
+	}
+	if f.maxBytes > 0 && f.bytes+len(chunk) > f.maxBytes {
+		return status.Errorf(codes.ResourceExhausted, "stream output is over the %d byte limit", f.maxBytes)
+	}
+	if merge {
+		f.chunks[len(f.chunks)-1] += chunk
+	} else {
+		f.chunks = append(f.chunks, chunk)
+	}
+	f.bytes += len(chunk)
+	close(f.updated)
+	f.updated = make(chan struct{})
+	return nil
+}
+
+// stall counts the stream as stalled until a follower takes a message. The
+// caller holds the mutex.
+func (f *flightStream) stall() {
+	if !f.stalled {
+		f.stalled = true
+		bufferMetrics.Add("stalled", 1)
+		bufferMetrics.Add("stalls", 1)
+	}
+}
+
+func (f *flightStream) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped != nil {
+		err = f.stopped
+	}
+	if f.stalled {
+		f.stalled = false
+		bufferMetrics.Add("stalled", -1)
+	}
+	f.done, f.err = true, err
+	close(f.updated)
+}
+
+// stop cancels the backend stream, which then ends with err, and reports
+// whether it was still running.
+func (f *flightStream) stop(err error) bool {
+	f.mu.Lock()
+	running := !f.done && f.stopped == nil
+	if running {
+		f.stopped = err
+	}
+	f.mu.Unlock()
+	f.cancel()
+	return running
+}
+
+// leave stops following a stream, cancelling the backend stream once nobody
+// is following it.
+func (g *streamGroup) leave(key string, flight *flightStream) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	flight.waiters--
+	if flight.waiters == 0 {
+		flight.cancel()
+		if g.streams[key] == flight {
+			delete(g.streams, key)
+		}
+	}
+}
+
+func (g *streamGroup) forget(key string, flight *flightStream) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.streams[key] == flight {
+		delete(g.streams, key)
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+
+	"azuremachinelearning.com/scorer/compression"
+)
+
+// Responses use the compressor the client sent its request with, so the
+// server only decides which messages are too small to be worth compressing.
+var compressionMinBytes = flag.Int("compression-min-bytes", 1024, "Messages smaller than this are sent uncompressed even when compression was negotiated")
+
+func init() {
+	expvar.Publish("compression", expvar.Func(func() interface{} {
+		return compression.Snapshot()
+	}))
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	connectServicePath       = "/scorer.Scorer/"
+	connectStreamContentType = "application/connect+"
+	connectTimeoutHeader     = "Connect-Timeout-Ms"
+	connectTrailerPrefix     = "Trailer-"
+
+	connectFlagCompressed = 0x01
+	connectFlagEndStream  = 0x02
+
+	// connectMaxMessageSize is the largest request message accepted, the
+	// same as gRPC's default receive limit.
+	connectMaxMessageSize = 4 << 20
+)
+
+// connectHandler serves the Scorer service over the Connect protocol, so plain
+// HTTP clients can call it with JSON or binary protobuf bodies. Requests are
+// adapted onto the gRPC implementation so both protocols share it, along with
+// the interceptors that track, record and fault calls.
+type connectHandler struct {
+	scorer pb.ScorerServer
+	chain  callChain
+}
+
+func registerConnectHandlers(mux *http.ServeMux, scorer pb.ScorerServer, chain callChain) {
+	mux.Handle(connectServicePath, &connectHandler{scorer: scorer, chain: chain})
+}
+
+func (h *connectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, connectServicePath)
+	contentType := r.Header.Get("Content-Type")
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Connect requests must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if method == "Score" {
+		codec, ok := connectCodec(contentType, false)
+		if !ok {
+			http.Error(w, fmt.Sprintf("unsupported content-type %q", contentType), http.StatusUnsupportedMediaType)
+			return
+		}
+		h.unary(w, r, codec)
+		return
+	}
+
+	codec, ok := connectCodec(contentType, true)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported content-type %q", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	stream, cancel := newConnectStream(w, r, codec, method)
+	defer cancel()
+
+	info := &grpc.StreamServerInfo{FullMethod: stream.method}
+	var handler grpc.StreamHandler
+	switch method {
+	case "StreamingRequestScore":
+		info.IsClientStream = true
+		handler = func(server interface{}, stream grpc.ServerStream) error {
+			return h.scorer.StreamingRequestScore(&connectRequestStream{stream})
+		}
+	case "StreamingResponseScore":
+		info.IsServerStream = true
+		handler = func(server interface{}, stream grpc.ServerStream) error {
+			request := &pb.InferenceRequest{}
+			if err := stream.RecvMsg(request); err != nil {
+				return err
+			}
+			return h.scorer.StreamingResponseScore(request, &connectResponseStream{stream})
+		}
+	case "ResumeStreamingResponseScore":
+		info.IsServerStream = true
+		handler = func(server interface{}, stream grpc.ServerStream) error {
+			request := &pb.ResumeRequest{}
+			if err := stream.RecvMsg(request); err != nil {
+				return err
+			}
+			return h.scorer.ResumeStreamingResponseScore(request, &connectResponseStream{stream})
+		}
+	case "BidirectionalScore":
+		if r.ProtoMajor < 2 {
+			stream.end(status.Error(codes.Unimplemented, "bidirectional streams require HTTP/2"))
+			return
+		}
+		info.IsClientStream, info.IsServerStream = true, true
+		handler = func(server interface{}, stream grpc.ServerStream) error {
+			return h.scorer.BidirectionalScore(&connectBidiStream{stream})
+		}
+	default:
+		stream.end(status.Errorf(codes.Unimplemented, "unknown method %s", method))
+		return
+	}
+	stream.end(h.chain.callStream(h.scorer, stream, info, handler))
+}
+
+// connectCodec returns the codec named by a Connect content-type: unary calls
+// use application/json or application/proto, streams application/connect+json
+// or application/connect+proto.
+func connectCodec(contentType string, streaming bool) (string, bool) {
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	prefix := "application/"
+	if streaming {
+		prefix = connectStreamContentType
+	}
+	if !strings.HasPrefix(contentType, prefix) {
+		return "", false
+	}
+	codec := strings.TrimPrefix(contentType, prefix)
+	return codec, codec == "json" || codec == "proto"
+}
+
+func (h *connectHandler) unary(w http.ResponseWriter, r *http.Request, codec string) {
+	stream, cancel := newConnectStream(w, r, codec, "Score")
+	defer cancel()
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, connectMaxMessageSize))
+	if err != nil {
+		// MaxBytesReader hands out the whole limit before failing.
+		if len(body) == connectMaxMessageSize {
+			writeConnectError(w, status.Errorf(codes.ResourceExhausted, "request is larger than %d bytes", connectMaxMessageSize))
+			return
+		}
+		writeConnectError(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+	request := &pb.InferenceRequest{}
+	if err := connectUnmarshal(codec, body, request); err != nil {
+		writeConnectError(w, status.Errorf(codes.InvalidArgument, "could not parse request: %v", err))
+		return
+	}
+	info := &grpc.UnaryServerInfo{Server: h.scorer, FullMethod: stream.method}
+	response, err := h.chain.callUnary(stream.ctx, request, info, func(ctx context.Context, request interface{}) (interface{}, error) {
+		return h.scorer.Score(ctx, request.(*pb.InferenceRequest))
+	})
+	for key, values := range stream.header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	for key, values := range stream.trailer {
+		for _, value := range values {
+			w.Header().Add(connectTrailerPrefix+key, value)
+		}
+	}
+	if err != nil {
+		writeConnectError(w, err)
+		return
+	}
+	data, err := connectMarshal(codec, response.(proto.Message))
+	if err != nil {
+		writeConnectError(w, status.Error(codes.Internal, err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/"+codec)
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// connectStream adapts an HTTP exchange to grpc.ServerStream and
+// grpc.ServerTransportStream. Streaming requests and responses are framed in
+// Connect envelopes: a flags byte, a big-endian length and the message.
+type connectStream struct {
+	ctx         context.Context
+	method      string
+	codec       string
+	w           http.ResponseWriter
+	body        io.Reader
+	header      metadata.MD
+	trailer     metadata.MD
+	wroteHeader bool
+}
+
+func newConnectStream(w http.ResponseWriter, r *http.Request, codec, method string) (*connectStream, context.CancelFunc) {
+	stream := &connectStream{
+		method:  "/scorer.Scorer/" + method,
+		codec:   codec,
+		w:       w,
+		body:    r.Body,
+		header:  metadata.MD{},
+		trailer: metadata.MD{},
+	}
+	ctx, cancel := context.WithCancel(incomingContext(r))
+	if timeout, err := strconv.ParseInt(r.Header.Get(connectTimeoutHeader), 10, 64); err == nil && timeout > 0 {
+		cancel()
+		ctx, cancel = context.WithTimeout(incomingContext(r), time.Duration(timeout)*time.Millisecond)
+	}
+	stream.ctx = grpc.NewContextWithServerTransportStream(ctx, connectTransport{stream})
+	return stream, cancel
+}
+
+// connectTransport lets grpc.SetHeader and grpc.SetTrailer reach the stream
+// from a handler's context.
+type connectTransport struct{ *connectStream }
+
+func (t connectTransport) Method() string { return t.method }
+
+func (t connectTransport) SetTrailer(md metadata.MD) error {
+	t.connectStream.SetTrailer(md)
+	return nil
+}
+
+func (s *connectStream) Context() context.Context { return s.ctx }
+
+func (s *connectStream) SetHeader(md metadata.MD) error {
+	if s.wroteHeader {
+		return errors.New("headers already sent")
+	}
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *connectStream) SendHeader(md metadata.MD) error {
+	if err := s.SetHeader(md); err != nil {
+		return err
+	}
+	s.writeHeader()
+	return nil
+}
+
+func (s *connectStream) SetTrailer(md metadata.MD) {
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *connectStream) writeHeader() {
+	if s.wroteHeader {
+		return
+	}
+	s.wroteHeader = true
+	for key, values := range s.header {
+		for _, value := range values {
+			s.w.Header().Add(key, value)
+		}
+	}
+	s.w.Header().Set("Content-Type", connectStreamContentType+s.codec)
+	s.w.WriteHeader(http.StatusOK)
+}
+
+func (s *connectStream) SendMsg(m interface{}) error {
+	data, err := connectMarshal(s.codec, m.(proto.Message))
+	if err != nil {
+		return err
+	}
+	return s.writeEnvelope(0, data)
+}
+
+func (s *connectStream) RecvMsg(m interface{}) error {
+	var prefix [5]byte
+	if _, err := io.ReadFull(s.body, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return status.Error(codes.InvalidArgument, "truncated envelope")
+		}
+		return err
+	}
+	if prefix[0]&connectFlagCompressed != 0 {
+		return status.Error(codes.Unimplemented, "compressed envelopes are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > connectMaxMessageSize {
+		return status.Errorf(codes.ResourceExhausted, "message is larger than %d bytes", connectMaxMessageSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(s.body, data); err != nil {
+		return status.Error(codes.InvalidArgument, "truncated envelope")
+	}
+	if err := connectUnmarshal(s.codec, data, m.(proto.Message)); err != nil {
+		return status.Errorf(codes.InvalidArgument, "could not parse request: %v", err)
+	}
+	return nil
+}
+
+func (s *connectStream) writeEnvelope(flags byte, data []byte) error {
+	s.writeHeader()
+	var prefix [5]byte
+	prefix[0] = flags
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(data)))
+	if _, err := s.w.Write(append(prefix[:], data...)); err != nil {
+		return err
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// end writes the end-of-stream envelope carrying the error, if any, and the
+// trailers.
+func (s *connectStream) end(err error) {
+	type endError struct {
+		Code    string `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	end := struct {
+		Error    *endError   `json:"error,omitempty"`
+		Metadata metadata.MD `json:"metadata,omitempty"`
+	}{Metadata: s.trailer}
+	if err != nil {
+		st := status.Convert(err)
+		end.Error = &endError{Code: snakeCase(st.Code().String()), Message: st.Message()}
+	}
+	data, _ := json.Marshal(end)
+	s.writeEnvelope(connectFlagEndStream, data)
+}
+
+type connectRequestStream struct{ grpc.ServerStream }
+
+func (s *connectRequestStream) Recv() (*pb.InferenceRequest, error) {
+	request := &pb.InferenceRequest{}
+	return request, s.RecvMsg(request)
+}
+
+func (s *connectRequestStream) SendAndClose(response *pb.InferenceResponse) error {
+	return s.SendMsg(response)
+}
+
+type connectResponseStream struct{ grpc.ServerStream }
+
+func (s *connectResponseStream) Send(response *pb.InferenceResponse) error {
+	return s.SendMsg(response)
+}
+
+type connectBidiStream struct{ grpc.ServerStream }
+
+func (s *connectBidiStream) Recv() (*pb.InferenceRequest, error) {
+	request := &pb.InferenceRequest{}
+	return request, s.RecvMsg(request)
+}
+
+func (s *connectBidiStream) Send(response *pb.InferenceResponse) error {
+	return s.SendMsg(response)
+}
+
+func connectMarshal(codec string, m proto.Message) ([]byte, error) {
+	if codec == "json" {
+		return protojson.Marshal(m)
+	}
+	return proto.Marshal(m)
+}
+
+func connectUnmarshal(codec string, data []byte, m proto.Message) error {
+	if codec == "json" {
+		if len(bytes.TrimSpace(data)) == 0 {
+			return nil
+		}
+		return protojson.Unmarshal(data, m)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// writeConnectError writes a unary Connect error body.
+func writeConnectError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	body := map[string]string{"code": snakeCase(st.Code().String())}
+	if st.Message() != "" {
+		body["message"] = st.Message()
+	}
+	writeJSON(w, httpStatusFromCode(st.Code()), body)
+}
+
+// httpStatusFromCode maps a gRPC status code to the HTTP status the Connect
+// protocol uses for it.
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
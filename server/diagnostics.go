@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// registerDiagnostics mounts the metrics and the runtime profilers on the
+// admin mux. The shared port never serves them.
+func registerDiagnostics(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/vars", metrics)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/admin/snapshot", snapshot)
+}
+
+// metrics answers GET /debug/vars like expvar.Handler, without the command
+// line, which may carry secrets.
+func metrics(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprint(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprint(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprint(w, "\n}\n")
+}
+
+// runtimeSnapshot is a point-in-time view of goroutines and the heap, for
+// spotting handlers that leak goroutines or hold on to messages.
+type runtimeSnapshot struct {
+	Time       time.Time        `json:"time"`
+	Goroutines int              `json:"goroutines"`
+	Heap       heapSnapshot     `json:"heap"`
+	Stacks     []goroutineStack `json:"stacks,omitempty"`
+}
+
+type heapSnapshot struct {
+	Alloc      uint64 `json:"alloc"`
+	InUse      uint64 `json:"inUse"`
+	Objects    uint64 `json:"objects"`
+	Sys        uint64 `json:"sys"`
+	NextGC     uint64 `json:"nextGC"`
+	NumGC      uint32 `json:"numGC"`
+	PauseTotal string `json:"pauseTotal"`
+}
+
+// goroutineStack counts the goroutines sharing a stack, innermost frame first.
+type goroutineStack struct {
+	Count  int      `json:"count"`
+	Frames []string `json:"frames"`
+}
+
+// snapshot answers GET /admin/snapshot. Goroutines are grouped by stack, most
+// common first, unless stacks=false.
+func snapshot(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+	s := runtimeSnapshot{
+		Time:       time.Now(),
+		Goroutines: runtime.NumGoroutine(),
+		Heap: heapSnapshot{
+			Alloc:      memory.HeapAlloc,
+			InUse:      memory.HeapInuse,
+			Objects:    memory.HeapObjects,
+			Sys:        memory.HeapSys,
+			NextGC:     memory.NextGC,
+			NumGC:      memory.NumGC,
+			PauseTotal: time.Duration(memory.PauseTotalNs).String(),
+		},
+	}
+	if r.URL.Query().Get("stacks") != "false" {
+		var profile bytes.Buffer
+		rpprof.Lookup("goroutine").WriteTo(&profile, 1)
+		s.Stacks = parseGoroutineProfile(profile.String())
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// parseGoroutineProfile reads the debug=1 goroutine profile, made of blocks
+// like
+//
+//	3 @ 0x43a8d6 0x4078ec
+//	#	0x4a1b2c	main.(*scorerServer).Score+0x2c	/src/server.go:240
+//
+// separated by blank lines.
+func parseGoroutineProfile(profile string) []goroutineStack {
+	var stacks []goroutineStack
+	for _, block := range strings.Split(profile, "\n\n") {
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+		if strings.HasPrefix(lines[0], "goroutine profile:") {
+			lines = lines[1:]
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		header := strings.Fields(lines[0])
+		if len(header) == 0 {
+			continue
+		}
+		count, err := strconv.Atoi(header[0])
+		if err != nil {
+			continue
+		}
+		stack := goroutineStack{Count: count}
+		for _, line := range lines[1:] {
+			fields := strings.Fields(strings.TrimPrefix(line, "#"))
+			if len(fields) < 3 {
+				continue
+			}
+			stack.Frames = append(stack.Frames, fields[1]+" "+fields[2])
+		}
+		stacks = append(stacks, stack)
+	}
+	return stacks
+}
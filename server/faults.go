@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	faultConfigPath = flag.String("fault-config", "", "JSON file of faults injected into gRPC calls for chaos testing")
+	faultMetadata   = flag.Bool("fault-metadata", false, "Let callers request faults with the x-fault header; never enable in production")
+)
+
+var faultMetrics = expvar.NewMap("faults")
+
+// faultConfig lists fault rules. For each call the first rule whose method
+// matches and whose percentage fires applies.
+type faultConfig struct {
+	Faults []faultRule `json:"faults"`
+}
+
+// faultRule injects faults into a percentage of calls to a method, given as
+// a full method name, a service prefix such as "/scorer.Scorer/*", or "*" for
+// every method. The call is delayed first. Streams then deliver truncateAfter
+// responses, if set, before ending with the fault; unary calls and streams
+// without truncateAfter fail at the start. The fault is a connection reset,
+// the abort code, or for truncated streams a clean end when neither is set.
+// Drop discards that fraction of stream responses.
+type faultRule struct {
+	Method        string     `json:"method"`
+	Percent       *float64   `json:"percent,omitempty"`
+	Delay         string     `json:"delay,omitempty"`
+	Abort         codes.Code `json:"abort,omitempty"`
+	Drop          float64    `json:"drop,omitempty"`
+	TruncateAfter int        `json:"truncateAfter,omitempty"`
+	Reset         bool       `json:"reset,omitempty"`
+}
+
+type fault struct {
+	method        string
+	percent       float64
+	delay         time.Duration
+	abort         codes.Code
+	drop          float64
+	truncateAfter int
+	reset         bool
+}
+
+func newFault(rule faultRule) (*fault, error) {
+	f := &fault{
+		method:        rule.Method,
+		percent:       100,
+		abort:         rule.Abort,
+		drop:          rule.Drop,
+		truncateAfter: rule.TruncateAfter,
+		reset:         rule.Reset,
+	}
+	if f.method == "" {
+		f.method = "*"
+	}
+	if rule.Percent != nil {
+		f.percent = *rule.Percent
+	}
+	if f.percent < 0 || f.percent > 100 {
+		return nil, fmt.Errorf("percent %v is not between 0 and 100", f.percent)
+	}
+	if rule.Delay != "" {
+		delay, err := time.ParseDuration(rule.Delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay %q: %v", rule.Delay, err)
+		}
+		f.delay = delay
+	}
+	if f.drop < 0 || f.drop > 1 {
+		return nil, fmt.Errorf("drop %v is not between 0 and 1", f.drop)
+	}
+	if f.truncateAfter < 0 {
+		return nil, fmt.Errorf("truncateAfter must not be negative")
+	}
+	return f, nil
+}
+
+// parseFaultHeader reads a fault from the x-fault header, written like the
+// JSON rule as comma-separated settings, e.g. "delay=200ms,abort=UNAVAILABLE"
+// or "truncateAfter=3,reset". The fault applies to the call carrying it.
+func parseFaultHeader(value string) (*fault, error) {
+	var rule faultRule
+	for _, setting := range strings.Split(value, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		var err error
+		switch key {
+		case "percent":
+			var percent float64
+			percent, err = strconv.ParseFloat(value, 64)
+			rule.Percent = &percent
+		case "delay":
+			rule.Delay = value
+		case "abort":
+			rule.Abort, err = parseCode(value)
+		case "drop":
+			rule.Drop, err = strconv.ParseFloat(value, 64)
+		case "truncateAfter":
+			rule.TruncateAfter, err = strconv.Atoi(value)
+		case "reset":
+			rule.Reset = true
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", setting, err)
+		}
+	}
+	return newFault(rule)
+}
+
+// parseCode reads a gRPC code by its name, such as "UNAVAILABLE".
+func parseCode(name string) (codes.Code, error) {
+	var code codes.Code
+	err := code.UnmarshalJSON([]byte(strconv.Quote(name)))
+	return code, err
+}
+
+func (f *fault) matches(method string) bool {
+	if prefix := strings.TrimSuffix(f.method, "*"); prefix != f.method {
+		return strings.HasPrefix(method, prefix)
+	}
+	return method == f.method
+}
+
+func (f *fault) fires() bool {
+	return f.percent >= 100 || rand.Float64()*100 < f.percent
+}
+
+// faultInjector injects faults into gRPC calls so clients' retry and resume
+// logic can be tested against the real server. Connections are tracked by
+// peer address so a fault can reset the one a call arrived on.
+type faultInjector struct {
+	faults       []*fault
+	fromMetadata bool
+
+	mu    sync.Mutex
+	conns map[string]net.Conn
+}
+
+func loadFaults(path string, fromMetadata bool) (*faultInjector, error) {
+	var config faultConfig
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+	}
+	return newFaultInjector(config, fromMetadata)
+}
+
+func newFaultInjector(config faultConfig, fromMetadata bool) (*faultInjector, error) {
+	i := &faultInjector{fromMetadata: fromMetadata, conns: map[string]net.Conn{}}
+	for n, rule := range config.Faults {
+		f, err := newFault(rule)
+		if err != nil {
+			return nil, fmt.Errorf("fault %d: %v", n+1, err)
+		}
+		i.faults = append(i.faults, f)
+	}
+	return i, nil
+}
+
+// fault picks the fault injected into a call, if any.
+func (i *faultInjector) fault(ctx context.Context, method string) (*fault, error) {
+	if i.fromMetadata {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if value := firstValue(md, faultHeader); value != "" {
+			f, err := parseFaultHeader(value)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid %s header: %v", faultHeader, err)
+			}
+			if !f.fires() {
+				return nil, nil
+			}
+			return f, nil
+		}
+	}
+	for _, f := range i.faults {
+		if f.matches(method) && f.fires() {
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+func (i *faultInjector) unaryInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	f, err := i.fault(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return handler(ctx, request)
+	}
+	if err := i.start(ctx, f, false); err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+func (i *faultInjector) streamInterceptor(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	f, err := i.fault(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return handler(server, stream)
+	}
+	if err := i.start(stream.Context(), f, true); err != nil {
+		return err
+	}
+	faulty := &faultStream{ServerStream: stream, injector: i, fault: f}
+	err = handler(server, faulty)
+	if faulty.truncated {
+		return faulty.err
+	}
+	return err
+}
+
+// start delays a call and fails it unless the fault waits to truncate a
+// stream.
+func (i *faultInjector) start(ctx context.Context, f *fault, streaming bool) error {
+	faultMetrics.Add("injected", 1)
+	if f.delay > 0 {
+		faultMetrics.Add("delayed", 1)
+		if err := sleep(ctx, f.delay); err != nil {
+			return err
+		}
+	}
+	if streaming && f.truncateAfter > 0 {
+		return nil
+	}
+	return i.fail(ctx, f)
+}
+
+// fail resets the call's connection or aborts the call as the fault says.
+func (i *faultInjector) fail(ctx context.Context, f *fault) error {
+	switch {
+	case f.reset:
+		faultMetrics.Add("reset", 1)
+		if !i.reset(ctx) {
+			warningf("No connection to reset, failing the call instead")
+		}
+		return status.Error(codes.Unavailable, "injected connection reset")
+	case f.abort != codes.OK:
+		faultMetrics.Add("aborted", 1)
+		return status.Errorf(f.abort, "injected %s fault", f.abort)
+	default:
+		return nil
+	}
+}
+
+// reset closes the connection a call arrived on, with an RST where it is
+// TCP, and reports whether it was found.
+func (i *faultInjector) reset(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	i.mu.Lock()
+	conn := i.conns[p.Addr.String()]
+	delete(i.conns, p.Addr.String())
+	i.mu.Unlock()
+	if conn == nil {
+		return false
+	}
+	for unwrapped := conn; unwrapped != nil; {
+		switch c := unwrapped.(type) {
+		case *cmux.MuxConn:
+			unwrapped = c.Conn
+		case *tls.Conn:
+			unwrapped = c.NetConn()
+		case *net.TCPConn:
+			c.SetLinger(0)
+			unwrapped = nil
+		default:
+			unwrapped = nil
+		}
+	}
+	conn.Close()
+	return true
+}
+
+// listener tracks the connections gRPC accepts so faults can reset them.
+func (i *faultInjector) listener(l net.Listener) net.Listener {
+	return &faultListener{Listener: l, injector: i}
+}
+
+type faultListener struct {
+	net.Listener
+	injector *faultInjector
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	key := conn.RemoteAddr().String()
+	l.injector.mu.Lock()
+	l.injector.conns[key] = conn
+	l.injector.mu.Unlock()
+	return &trackedConn{Conn: conn, injector: l.injector, key: key}, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	injector *faultInjector
+	key      string
+}
+
+func (c *trackedConn) Close() error {
+	c.injector.mu.Lock()
+	if c.injector.conns[c.key] == c.Conn {
+		delete(c.injector.conns, c.key)
+	}
+	c.injector.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// faultStream drops and truncates the responses of a faulty stream.
+type faultStream struct {
+	grpc.ServerStream
+	injector  *faultInjector
+	fault     *fault
+	sent      int
+	truncated bool
+	err       error
+}
+
+var errTruncated = status.Error(codes.Aborted, "stream truncated by an injected fault")
+
+func (s *faultStream) SendMsg(m interface{}) error {
+	if s.truncated {
+		return errTruncated
+	}
+	if s.fault.truncateAfter > 0 && s.sent == s.fault.truncateAfter {
+		faultMetrics.Add("truncated", 1)
+		s.truncated = true
+		s.err = s.injector.fail(s.Context(), s.fault)
+		return errTruncated
+	}
+	if s.fault.drop > 0 && rand.Float64() < s.fault.drop {
+		faultMetrics.Add("dropped", 1)
+		return nil
+	}
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	s.sent++
+	return nil
+}
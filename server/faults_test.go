@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestParseFaultHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   fault
+		err    bool
+	}{
+		{header: "abort=UNAVAILABLE", want: fault{method: "*", percent: 100, abort: codes.Unavailable}},
+		{header: "delay=20ms, percent=50", want: fault{method: "*", percent: 50, delay: 20 * time.Millisecond}},
+		{header: "truncateAfter=3,reset,drop=0.5", want: fault{method: "*", percent: 100, truncateAfter: 3, reset: true, drop: 0.5}},
+		{header: "abort=BROKEN", err: true},
+		{header: "delay=soon", err: true},
+		{header: "percent=150", err: true},
+		{header: "drop=2", err: true},
+		{header: "explode", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			got, err := parseFaultHeader(test.header)
+			if test.err {
+				if err == nil {
+					t.Errorf("Got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != test.want {
+				t.Errorf("Got %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	never := 0.0
+	faults, err := newFaultInjector(faultConfig{Faults: []faultRule{
+		{Method: "/scorer.Scorer/StreamingRequestScore", Abort: codes.ResourceExhausted},
+		{Method: "/scorer.Scorer/*", Percent: &never, Abort: codes.Internal},
+	}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startFaultyServer(t, faults)
+	withFault := func(t *testing.T, header string) context.Context {
+		return metadata.AppendToOutgoingContext(testContext(t), faultHeader, header)
+	}
+
+	unary := []struct {
+		name   string
+		header string
+		code   codes.Code
+		delay  time.Duration
+	}{
+		{name: "none", code: codes.OK},
+		{name: "abort", header: "abort=UNAVAILABLE", code: codes.Unavailable},
+		{name: "delay", header: "delay=50ms", code: codes.OK, delay: 50 * time.Millisecond},
+		{name: "never fires", header: "abort=INTERNAL,percent=0", code: codes.OK},
+		{name: "invalid header", header: "abort=BROKEN", code: codes.InvalidArgument},
+	}
+	for _, test := range unary {
+		t.Run("unary "+test.name, func(t *testing.T) {
+			ctx := testContext(t)
+			if test.header != "" {
+				ctx = withFault(t, test.header)
+			}
+			start := time.Now()
+			_, err := server.client.Score(ctx, &pb.InferenceRequest{Prompt: "Today is"})
+			checkCode(t, err, test.code)
+			if elapsed := time.Since(start); elapsed < test.delay {
+				t.Errorf("Answered after %v, before the %v delay", elapsed, test.delay)
+			}
+		})
+	}
+
+	streams := []struct {
+		name      string
+		header    string
+		code      codes.Code
+		responses int
+	}{
+		{name: "none", code: codes.OK, responses: 10},
+		{name: "truncate", header: "truncateAfter=3", code: codes.OK, responses: 3},
+		{name: "truncate and abort", header: "truncateAfter=3,abort=UNAVAILABLE", code: codes.Unavailable, responses: 3},
+		{name: "drop all", header: "drop=1", code: codes.OK, responses: 0},
+		{name: "abort", header: "abort=DATA_LOSS", code: codes.DataLoss, responses: 0},
+	}
+	for _, test := range streams {
+		t.Run("stream "+test.name, func(t *testing.T) {
+			ctx := testContext(t)
+			if test.header != "" {
+				ctx = withFault(t, test.header)
+			}
+			stream, err := server.client.StreamingResponseScore(ctx, &pb.InferenceRequest{Prompt: "Today is"})
+			checkCode(t, err, codes.OK)
+			responses, err := receiveAll(stream)
+			checkCode(t, err, test.code)
+			if len(responses) != test.responses {
+				t.Errorf("Got %d responses, want %d", len(responses), test.responses)
+			}
+		})
+	}
+
+	t.Run("config rule", func(t *testing.T) {
+		stream, err := server.client.StreamingRequestScore(testContext(t))
+		checkCode(t, err, codes.OK)
+		_, err = stream.CloseAndRecv()
+		checkCode(t, err, codes.ResourceExhausted)
+	})
+}
+
+// TestFaultReset resets a connection on the shared port, which the client
+// sees as the connection going away rather than as the call's status.
+func TestFaultReset(t *testing.T) {
+	faults, err := newFaultInjector(faultConfig{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startFaultyServer(t, faults)
+	conn, err := grpc.Dial(server.address, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewScorerClient(conn)
+
+	ctx := metadata.AppendToOutgoingContext(testContext(t), faultHeader, "reset")
+	_, err = client.Score(ctx, &pb.InferenceRequest{Prompt: "Today is"})
+	checkCode(t, err, codes.Unavailable)
+	faults.mu.Lock()
+	tracked := len(faults.conns)
+	faults.mu.Unlock()
+	if tracked != 0 {
+		t.Errorf("%d connections still tracked after the reset", tracked)
+	}
+
+	response, err := client.Score(testContext(t), &pb.InferenceRequest{Prompt: "Today is"})
+	checkCode(t, err, codes.OK)
+	if response.GetResult() != "Today is sunny" {
+		t.Errorf("Got %q after reconnecting", response.GetResult())
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	_ "google.golang.org/grpc/health" // enables upstream health checking
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	upstreamHeader     = "x-upstream"
+	forwardedForHeader = "x-forwarded-for"
+
+	// upstreamServiceConfig balances across an upstream's addresses and only
+	// uses those whose gRPC health service reports SERVING.
+	upstreamServiceConfig = `{"loadBalancingConfig": [{"round_robin": {}}], "healthCheckConfig": {"serviceName": ""}}`
+)
+
+var gatewayConfigPath = flag.String("gateway-config", "", "JSON file of upstream scorer servers; when set, Scorer calls are forwarded to them instead of served locally")
+
+// gatewayConfig lists the upstream pools and which requests go to each.
+type gatewayConfig struct {
+	Upstreams []upstreamConfig `json:"upstreams"`
+	Routes    []gatewayRoute   `json:"routes,omitempty"`
+	// Default receives requests no route matches; the first upstream if empty.
+	Default string              `json:"default,omitempty"`
+	Retry   *gatewayRetryConfig `json:"retry,omitempty"`
+}
+
+type upstreamConfig struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+}
+
+// gatewayRoute sends requests for any of Models from any of Tenants to an
+// upstream. An empty list matches everything.
+type gatewayRoute struct {
+	Models   []string `json:"models,omitempty"`
+	Tenants  []string `json:"tenants,omitempty"`
+	Upstream string   `json:"upstream"`
+}
+
+// gatewayRetryConfig retries unary calls; streams are never replayed.
+type gatewayRetryConfig struct {
+	MaxAttempts          int          `json:"maxAttempts"`
+	Backoff              string       `json:"backoff"`
+	RetryableStatusCodes []codes.Code `json:"retryableStatusCodes"`
+}
+
+type pinnedUpstream struct {
+	name string
+	conn *grpc.ClientConn
+}
+
+type upstream struct {
+	name      string
+	addresses []string
+	conn      *grpc.ClientConn
+}
+
+// gateway implements the Scorer service by forwarding every call, including
+// full-duplex streams, to a pool of upstream scorer servers.
+type gateway struct {
+	pb.UnimplementedScorerServer
+	upstreams   []*upstream
+	byName      map[string]*upstream
+	routes      []gatewayRoute
+	fallback    *upstream
+	maxAttempts int
+	backoff     time.Duration
+	retryable   map[codes.Code]bool
+
+	mu     sync.Mutex
+	pinned map[string]*pinnedUpstream
+}
+
+func loadGateway(path string) (*gateway, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config gatewayConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return newGateway(config)
+}
+
+func newGateway(config gatewayConfig) (*gateway, error) {
+	if len(config.Upstreams) == 0 {
+		return nil, fmt.Errorf("gateway has no upstreams")
+	}
+	g := &gateway{
+		byName:      map[string]*upstream{},
+		pinned:      map[string]*pinnedUpstream{},
+		routes:      config.Routes,
+		maxAttempts: 3,
+		backoff:     50 * time.Millisecond,
+		retryable:   map[codes.Code]bool{codes.Unavailable: true},
+	}
+	if retry := config.Retry; retry != nil {
+		g.maxAttempts = retry.MaxAttempts
+		if retry.Backoff != "" {
+			backoff, err := time.ParseDuration(retry.Backoff)
+			if err != nil {
+				return nil, fmt.Errorf("retry backoff: %v", err)
+			}
+			g.backoff = backoff
+		}
+		if len(retry.RetryableStatusCodes) > 0 {
+			g.retryable = map[codes.Code]bool{}
+			for _, code := range retry.RetryableStatusCodes {
+				g.retryable[code] = true
+			}
+		}
+	}
+	if g.maxAttempts < 1 {
+		g.maxAttempts = 1
+	}
+
+	for _, config := range config.Upstreams {
+		if config.Name == "" || len(config.Addresses) == 0 {
+			return nil, fmt.Errorf("upstream %q needs a name and addresses", config.Name)
+		}
+		if _, ok := g.byName[config.Name]; ok {
+			return nil, fmt.Errorf("upstream %q is listed twice", config.Name)
+		}
+		conn, err := dialUpstream(config.Addresses)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", config.Name, err)
+		}
+		u := &upstream{name: config.Name, addresses: config.Addresses, conn: conn}
+		g.upstreams = append(g.upstreams, u)
+		g.byName[u.name] = u
+	}
+	for _, route := range g.routes {
+		if g.byName[route.Upstream] == nil {
+			return nil, fmt.Errorf("route to unknown upstream %q", route.Upstream)
+		}
+	}
+	g.fallback = g.upstreams[0]
+	if config.Default != "" {
+		if g.fallback = g.byName[config.Default]; g.fallback == nil {
+			return nil, fmt.Errorf("unknown default upstream %q", config.Default)
+		}
+	}
+	return g, nil
+}
+
+// dialUpstream connects to a fixed set of addresses through a manual resolver.
+func dialUpstream(addresses []string) (*grpc.ClientConn, error) {
+	r := manual.NewBuilderWithScheme("upstream")
+	state := resolver.State{}
+	for _, address := range addresses {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: address})
+	}
+	r.InitialState(state)
+	return grpc.Dial(r.Scheme()+":///upstream",
+		grpc.WithInsecure(),
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(upstreamServiceConfig),
+	)
+}
+
+// route picks the upstream for a model and the caller's tenant.
+func (g *gateway) route(ctx context.Context, modelName string) *upstream {
+	md, _ := metadata.FromIncomingContext(ctx)
+	tenant := firstValue(md, tenantHeader)
+	for _, route := range g.routes {
+		if matchesAny(route.Models, modelName) && matchesAny(route.Tenants, tenant) {
+			return g.byName[route.Upstream]
+		}
+	}
+	return g.fallback
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedMetadata drops transport and gRPC reserved keys so only
+// application metadata crosses the gateway.
+func forwardedMetadata(md metadata.MD) metadata.MD {
+	forwarded := metadata.MD{}
+	for key, values := range md {
+		switch {
+		case strings.HasPrefix(key, ":"), strings.HasPrefix(key, "grpc-"),
+			key == "content-type", key == "user-agent", key == "te":
+			continue
+		}
+		forwarded[key] = values
+	}
+	return forwarded
+}
+
+// outgoingContext carries the caller's metadata to the upstream call.
+func outgoingContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	forwarded := forwardedMetadata(md)
+	if p, ok := peer.FromContext(ctx); ok {
+		forwarded.Append(forwardedForHeader, p.Addr.String())
+	}
+	return metadata.NewOutgoingContext(ctx, forwarded)
+}
+
+func (g *gateway) Score(ctx context.Context, request *pb.InferenceRequest) (*pb.InferenceResponse, error) {
+	upstream := g.route(ctx, request.GetModel())
+	client := pb.NewScorerClient(upstream.conn)
+	outgoing := outgoingContext(ctx)
+	for attempt := 1; ; attempt++ {
+		var header, trailer metadata.MD
+		response, err := client.Score(outgoing, request, grpc.Header(&header), grpc.Trailer(&trailer))
+		if err == nil || attempt >= g.maxAttempts || !g.retryable[status.Code(err)] || ctx.Err() != nil {
+			grpc.SetHeader(ctx, metadata.Join(forwardedMetadata(header), metadata.Pairs(upstreamHeader, upstream.name)))
+			grpc.SetTrailer(ctx, forwardedMetadata(trailer))
+			return response, err
+		}
+		warningf("Gateway Score to %s failed with %s, attempt %d of %d", upstream.name, status.Code(err), attempt, g.maxAttempts)
+		select {
+		case <-ctx.Done():
+		case <-time.After(g.backoff * time.Duration(attempt)):
+		}
+	}
+}
+
+func (g *gateway) StreamingRequestScore(stream pb.Scorer_StreamingRequestScoreServer) error {
+	return g.forward(stream, "/scorer.Scorer/StreamingRequestScore", &grpc.StreamDesc{ClientStreams: true}, nil)
+}
+
+func (g *gateway) StreamingResponseScore(request *pb.InferenceRequest, stream pb.Scorer_StreamingResponseScoreServer) error {
+	return g.forward(stream, "/scorer.Scorer/StreamingResponseScore", &grpc.StreamDesc{ServerStreams: true}, request)
+}
+
+func (g *gateway) BidirectionalScore(stream pb.Scorer_BidirectionalScoreServer) error {
+	method, desc := "/scorer.Scorer/BidirectionalScore", &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	token := firstValue(md, chatSessionHeader)
+	if token == "" || token == newChatSession {
+		return g.forward(stream, method, desc, nil)
+	}
+
+	// Reattaching to a chat goes to the upstream address holding its history.
+	id, conn, name := g.unpin(token)
+	if conn == nil {
+		return status.Errorf(codes.NotFound, "chat session %q was not started through this gateway", token)
+	}
+	md = md.Copy()
+	md.Set(chatSessionHeader, id)
+	downstream := &sessionStream{ServerStream: stream, ctx: metadata.NewIncomingContext(stream.Context(), md)}
+	first := &pb.InferenceRequest{}
+	firstErr := downstream.RecvMsg(first)
+	if firstErr != nil && firstErr != io.EOF {
+		return firstErr
+	}
+	return g.relay(downstream, name, conn, method, desc, first, firstErr)
+}
+
+// sessionStream presents a downstream stream whose session header carries
+// the upstream's own session ID.
+type sessionStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *sessionStream) Context() context.Context { return s.ctx }
+
+// ResumeStreamingResponseScore resumes a session on the upstream address
+// that started it, which the gateway recorded in the session token.
+func (g *gateway) ResumeStreamingResponseScore(request *pb.ResumeRequest, stream pb.Scorer_ResumeStreamingResponseScoreServer) error {
+	id, conn, name := g.unpin(request.GetSessionId())
+	if conn == nil {
+		return status.Errorf(codes.NotFound, "stream session %q was not started through this gateway", request.GetSessionId())
+	}
+	upstreamRequest := &pb.ResumeRequest{SessionId: id, LastSequence: request.GetLastSequence()}
+	return g.relay(stream, name, conn, "/scorer.Scorer/ResumeStreamingResponseScore", &grpc.StreamDesc{ServerStreams: true}, upstreamRequest, nil)
+}
+
+// forward relays a stream to the upstream chosen by the model of the first
+// request, which is read here unless the caller already has it.
+func (g *gateway) forward(downstream grpc.ServerStream, method string, desc *grpc.StreamDesc, first *pb.InferenceRequest) error {
+	var firstErr error
+	if first == nil {
+		first = &pb.InferenceRequest{}
+		if firstErr = downstream.RecvMsg(first); firstErr != nil && firstErr != io.EOF {
+			return firstErr
+		}
+	}
+	upstream := g.route(downstream.Context(), first.GetModel())
+	return g.relay(downstream, upstream.name, upstream.conn, method, desc, first, firstErr)
+}
+
+// relay pumps requests and responses between the downstream stream and an
+// upstream call concurrently, so full-duplex calls keep their interleaving.
+func (g *gateway) relay(downstream grpc.ServerStream, name string, conn *grpc.ClientConn, method string, desc *grpc.StreamDesc, first proto.Message, firstErr error) error {
+	ctx, cancel := context.WithCancel(outgoingContext(downstream.Context()))
+	defer cancel()
+	upstreamStream, err := conn.NewStream(ctx, desc, method)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		request, err := first, firstErr
+		for err == nil {
+			if err = upstreamStream.SendMsg(request); err != nil {
+				// The upstream finished; its status arrives through RecvMsg.
+				return
+			}
+			if !desc.ClientStreams {
+				err = io.EOF
+				break
+			}
+			request = first.ProtoReflect().New().Interface()
+			err = downstream.RecvMsg(request)
+		}
+		if err == io.EOF {
+			upstreamStream.CloseSend()
+			return
+		}
+		cancel()
+	}()
+
+	header, err := upstreamStream.Header()
+	if err == nil {
+		header = forwardedMetadata(header)
+		// Sessions live on one upstream address, so the token handed to the
+		// client names it for resuming or reattaching.
+		for _, key := range []string{streamSessionHeader, chatSessionHeader} {
+			if session := header.Get(key); len(session) > 0 {
+				if p, ok := peer.FromContext(upstreamStream.Context()); ok {
+					g.pin(p.Addr.String(), name)
+					header.Set(key, session[0]+"@"+p.Addr.String())
+				}
+			}
+		}
+		downstream.SendHeader(metadata.Join(header, metadata.Pairs(upstreamHeader, name)))
+	}
+	for {
+		response := &pb.InferenceResponse{}
+		if err := upstreamStream.RecvMsg(response); err != nil {
+			downstream.SetTrailer(forwardedMetadata(upstreamStream.Trailer()))
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := downstream.SendMsg(response); err != nil {
+			return err
+		}
+	}
+}
+
+// pin records an upstream address that served a session. Only recorded
+// addresses can be resumed, so tokens cannot point the gateway elsewhere.
+func (g *gateway) pin(address, name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.pinned[address]; !ok {
+		g.pinned[address] = &pinnedUpstream{name: name}
+	}
+}
+
+// unpin splits a session token handed out by relay into the upstream's
+// session ID and a connection to the address holding the session.
+func (g *gateway) unpin(token string) (string, *grpc.ClientConn, string) {
+	separator := strings.LastIndex(token, "@")
+	if separator < 0 {
+		return "", nil, ""
+	}
+	conn, name := g.pinnedConn(token[separator+1:])
+	return token[:separator], conn, name
+}
+
+// pinnedConn returns a connection to exactly one recorded upstream address.
+func (g *gateway) pinnedConn(address string) (*grpc.ClientConn, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	pinned := g.pinned[address]
+	if pinned == nil {
+		return nil, ""
+	}
+	if pinned.conn == nil {
+		conn, err := grpc.Dial(address, grpc.WithInsecure())
+		if err != nil {
+			return nil, ""
+		}
+		pinned.conn = conn
+	}
+	return pinned.conn, pinned.name
+}
+
+type upstreamStatus struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+	State     string   `json:"state"`
+}
+
+// healthcheck reports the connection state of every upstream, failing when
+// any upstream has no healthy address.
+func (g *gateway) healthcheck(w http.ResponseWriter, r *http.Request) {
+	var statuses []upstreamStatus
+	code := http.StatusOK
+	for _, u := range g.upstreams {
+		state := u.conn.GetState()
+		if state == connectivity.TransientFailure || state == connectivity.Shutdown {
+			code = http.StatusServiceUnavailable
+		}
+		statuses = append(statuses, upstreamStatus{Name: u.name, Addresses: u.addresses, State: state.String()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(statuses)
+}
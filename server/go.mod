@@ -1,11 +1,21 @@
 module azuremachinelearning.com/server
 
-go 1.16
+go 1.18
 
 replace azuremachinelearning.com/scorer => ../contract
 
 require (
 	azuremachinelearning.com/scorer v0.0.0-00010101000000-000000000000
-	github.com/soheilhy/cmux v0.1.5 // indirect
+	github.com/soheilhy/cmux v0.1.5
+	golang.org/x/net v0.0.0-20201202161906-c7110b5ffcbb
 	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.25.0
+)
+
+require (
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f // indirect
+	golang.org/x/text v0.3.3 // indirect
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 )
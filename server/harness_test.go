@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testServer runs the Scorer service in process. gRPC calls go over an
+// in-memory bufconn listener, while the shared port with cmux, gRPC and the
+// HTTP handlers listens on loopback at url. Calls are tracked as with the
+// admin API enabled.
+//
+// A new backend is tested by starting the server with a model config that
+// selects it, or by installing an instance on a model with setBackend.
+type testServer struct {
+	registry *modelRegistry
+	scorer   *scorerServer
+	calls    *callTracker
+	conn     *grpc.ClientConn
+	client   pb.ScorerClient
+	address  string
+	url      string
+}
+
+// testModel is the default echo model, streaming quickly enough for tests.
+var testModel = modelConfig{
+	Name:     defaultModelName,
+	Versions: []versionConfig{{Name: "v1", Weight: 100, Backend: backendConfig{Interval: "5ms"}}},
+}
+
+// startTestServer serves the given models, or testModel when none are given,
+// and stops everything when the test ends.
+func startTestServer(t *testing.T, models ...modelConfig) *testServer {
+	t.Helper()
+	return startFaultyServer(t, nil, models...)
+}
+
+// startFaultyServer is startTestServer with faults injected into gRPC calls.
+func startFaultyServer(t *testing.T, faults *faultInjector, models ...modelConfig) *testServer {
+	t.Helper()
+	if len(models) == 0 {
+		models = []modelConfig{testModel}
+	}
+	registry := newModelRegistry()
+	for _, config := range models {
+		if err := registry.add(config); err != nil {
+			t.Fatalf("Could not load model %s: %v", config.Name, err)
+		}
+	}
+	scorer := newScorerServer(registry)
+	calls := newCallTracker()
+
+	memory := bufconn.Listen(1 << 20)
+	grpcServer := newGRPCServer(registry, scorer, nil, faults, calls)
+	go grpcServer.Serve(memory)
+	t.Cleanup(grpcServer.Stop)
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return memory.Dial()
+		}),
+	)
+	if err != nil {
+		t.Fatalf("Could not dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	loopback, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen on loopback: %v", err)
+	}
+	go serve(loopback, registry, scorer, nil, faults, calls)
+	t.Cleanup(func() { loopback.Close() })
+
+	return &testServer{
+		registry: registry,
+		scorer:   scorer,
+		calls:    calls,
+		conn:     conn,
+		client:   pb.NewScorerClient(conn),
+		address:  loopback.Addr().String(),
+		url:      "http://" + loopback.Addr().String(),
+	}
+}
+
+// setBackend makes every version of a model serve from backend. Call it
+// before the model receives traffic.
+func (s *testServer) setBackend(t *testing.T, model string, backend modelBackend) {
+	t.Helper()
+	m := s.registry.get(model)
+	if m == nil {
+		t.Fatalf("Model %s is not loaded", model)
+	}
+	for _, version := range m.versions {
+		version.backend = backend
+	}
+}
+
+// setFlag overrides a flag value for the duration of a test. Flags read when
+// the server is built must be set before startTestServer.
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	previous := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = previous })
+}
+
+// funcBackend adapts functions to modelBackend, for tests that need a backend
+// to fail or block. A nil function falls back to the echo backend.
+type funcBackend struct {
+	score  func(ctx context.Context, prompt string) (string, error)
+	stream func(ctx context.Context, prompt string, send func(string) error) error
+}
+
+var fallbackBackend = &echoBackend{suffix: "sunny", chunks: 10}
+
+func (b *funcBackend) Score(ctx context.Context, prompt string, parameters *pb.GenerationParameters) (string, error) {
+	if b.score == nil {
+		return fallbackBackend.Score(ctx, prompt, parameters)
+	}
+	return b.score(ctx, prompt)
+}
+
+func (b *funcBackend) StreamScore(ctx context.Context, prompt string, parameters *pb.GenerationParameters, send func(string) error) error {
+	if b.stream == nil {
+		return fallbackBackend.StreamScore(ctx, prompt, parameters, send)
+	}
+	return b.stream(ctx, prompt, send)
+}
+
+// blockingBackend answers nothing until its call is cancelled, then closes
+// cancelled.
+func blockingBackend() (*funcBackend, <-chan struct{}) {
+	cancelled := make(chan struct{})
+	var once sync.Once
+	wait := func(ctx context.Context) error {
+		<-ctx.Done()
+		once.Do(func() { close(cancelled) })
+		return ctx.Err()
+	}
+	return &funcBackend{
+		score: func(ctx context.Context, prompt string) (string, error) {
+			return "", wait(ctx)
+		},
+		stream: func(ctx context.Context, prompt string, send func(string) error) error {
+			if err := send(prompt + " started"); err != nil {
+				return err
+			}
+			return wait(ctx)
+		},
+	}, cancelled
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	pb "azuremachinelearning.com/scorer"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+)
+
+// TestHTTP runs the HTTP side of the shared port over HTTP/1.1 and over h2c,
+// which cmux must tell apart from gRPC.
+func TestHTTP(t *testing.T) {
+	server := startTestServer(t)
+	transports := []struct {
+		name      string
+		transport http.RoundTripper
+	}{
+		{"HTTP/1.1", &http.Transport{}},
+		{"h2c", &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, address string, config *tls.Config) (net.Conn, error) {
+				return net.Dial(network, address)
+			},
+		}},
+	}
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		want        string
+	}{
+		{name: "healthcheck", method: http.MethodGet, path: "/healthcheck", status: http.StatusOK, want: "ok"},
+		{name: "model health", method: http.MethodGet, path: "/healthcheck/models", status: http.StatusOK, want: `"name":"default","state":"ready"`},
+		{name: "no metrics", method: http.MethodGet, path: "/debug/vars", status: http.StatusNotFound, want: "404 page not found"},
+		{
+			name: "Connect unary", method: http.MethodPost, path: "/scorer.Scorer/Score",
+			contentType: "application/json", body: `{"prompt":"Today is"}`,
+			status: http.StatusOK, want: `"result":"Today is sunny"`,
+		},
+		{
+			name: "Connect unknown model", method: http.MethodPost, path: "/scorer.Scorer/Score",
+			contentType: "application/json", body: `{"prompt":"Today is","model":"nope"}`,
+			status: http.StatusNotFound, want: `"code":"not_found"`,
+		},
+		{name: "OpenAI models", method: http.MethodGet, path: "/v1/models", status: http.StatusOK, want: `"id":"default"`},
+		{
+			name: "OpenAI chat", method: http.MethodPost, path: "/v1/chat/completions",
+			contentType: "application/json", body: `{"model":"default","messages":[{"role":"user","content":"Today is"}]}`,
+			status: http.StatusOK, want: `"role":"assistant"`,
+		},
+		{
+			name: "OpenAI max_tokens", method: http.MethodPost, path: "/v1/completions",
+			contentType: "application/json", body: `{"model":"default","prompt":"Today is","max_tokens":2}`,
+			status: http.StatusOK, want: `"finish_reason":"length"`,
+		},
+		{
+			name: "OpenAI max_tokens not reached", method: http.MethodPost, path: "/v1/completions",
+			contentType: "application/json", body: `{"model":"default","prompt":"Today is","max_tokens":3}`,
+			status: http.StatusOK, want: `"finish_reason":"stop"`,
+		},
+		{
+			name: "OpenAI stream max_tokens", method: http.MethodPost, path: "/v1/completions",
+			contentType: "application/json", body: `{"model":"default","prompt":"p","max_tokens":5,"stream":true}`,
+			status: http.StatusOK, want: `"finish_reason":"length"`,
+		},
+		{name: "unknown path", method: http.MethodGet, path: "/nope", status: http.StatusNotFound},
+	}
+	for _, transport := range transports {
+		client := &http.Client{Transport: transport.transport}
+		for _, test := range tests {
+			t.Run(transport.name+" "+test.name, func(t *testing.T) {
+				request, err := http.NewRequest(test.method, server.url+test.path, strings.NewReader(test.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if test.contentType != "" {
+					request.Header.Set("Content-Type", test.contentType)
+				}
+				response, err := client.Do(request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer response.Body.Close()
+				body, _ := ioutil.ReadAll(response.Body)
+				if response.StatusCode != test.status {
+					t.Fatalf("Got %d %s, want %d", response.StatusCode, body, test.status)
+				}
+				if !strings.Contains(string(body), test.want) {
+					t.Errorf("Body %s does not contain %s", body, test.want)
+				}
+			})
+		}
+	}
+}
+
+// TestSharedPortGRPC checks that cmux routes gRPC on the shared port.
+func TestSharedPortGRPC(t *testing.T) {
+	server := startTestServer(t)
+	conn, err := grpc.Dial(server.address, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	response, err := pb.NewScorerClient(conn).Score(context.Background(), &pb.InferenceRequest{Prompt: "Today is"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetResult() != "Today is sunny" {
+		t.Errorf("Got %q", response.GetResult())
+	}
+}
+
+// TestConnectCalls checks that Connect calls are size limited like gRPC ones
+// and pass through the same interceptors.
+func TestConnectCalls(t *testing.T) {
+	faults, err := newFaultInjector(faultConfig{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startFaultyServer(t, faults)
+	oversized := make([]byte, 5)
+	oversized[1], oversized[2], oversized[3], oversized[4] = 0xff, 0xff, 0xff, 0xff
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		fault       string
+		body        string
+		status      int
+		want        string
+	}{
+		{
+			name: "unary too large", path: "/scorer.Scorer/Score", contentType: "application/json",
+			body:   `{"prompt":"` + strings.Repeat("a", connectMaxMessageSize) + `"}`,
+			status: http.StatusTooManyRequests, want: `"code":"resource_exhausted"`,
+		},
+		{
+			name: "envelope too large", path: "/scorer.Scorer/StreamingResponseScore", contentType: "application/connect+json",
+			body: string(oversized), status: http.StatusOK, want: `"code":"resource_exhausted"`,
+		},
+		{
+			name: "unary fault", path: "/scorer.Scorer/Score", contentType: "application/json", fault: "abort=UNAVAILABLE",
+			body: `{"prompt":"Today is"}`, status: http.StatusServiceUnavailable, want: `"code":"unavailable"`,
+		},
+		{
+			name: "stream fault", path: "/scorer.Scorer/StreamingResponseScore", contentType: "application/connect+json", fault: "abort=UNAVAILABLE",
+			body: "\x00\x00\x00\x00\x15" + `{"prompt":"Today is"}`, status: http.StatusOK, want: `"code":"unavailable"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, err := http.NewRequest(http.MethodPost, server.url+test.path, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			request.Header.Set("Content-Type", test.contentType)
+			if test.fault != "" {
+				request.Header.Set(faultHeader, test.fault)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer response.Body.Close()
+			body, _ := ioutil.ReadAll(response.Body)
+			if response.StatusCode != test.status || !strings.Contains(string(body), test.want) {
+				t.Errorf("Got %d %s, want %d with %s", response.StatusCode, body, test.status, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	inference "azuremachinelearning.com/scorer/inference"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	inferenceServerName = "scorer"
+	inferencePlatform   = "scorer"
+	promptTensor        = "prompt"
+	resultTensor        = "result"
+	bytesDatatype       = "BYTES"
+)
+
+// inferenceServer implements the Open Inference Protocol (KServe v2) on top of
+// the model registry. Models take a BYTES tensor of prompts and return a BYTES
+// tensor of results of the same shape.
+type inferenceServer struct {
+	inference.UnimplementedGRPCInferenceServiceServer
+	registry *modelRegistry
+}
+
+func (s *inferenceServer) ServerLive(ctx context.Context, request *inference.ServerLiveRequest) (*inference.ServerLiveResponse, error) {
+	return &inference.ServerLiveResponse{Live: true}, nil
+}
+
+func (s *inferenceServer) ServerReady(ctx context.Context, request *inference.ServerReadyRequest) (*inference.ServerReadyResponse, error) {
+	ready := true
+	for _, status := range s.registry.list() {
+		if status.State == modelLoading {
+			ready = false
+		}
+	}
+	return &inference.ServerReadyResponse{Ready: ready}, nil
+}
+
+func (s *inferenceServer) ModelReady(ctx context.Context, request *inference.ModelReadyRequest) (*inference.ModelReadyResponse, error) {
+	m := s.registry.get(request.GetName())
+	if m == nil {
+		return &inference.ModelReadyResponse{Ready: false}, nil
+	}
+	ready := request.GetVersion() == "" || m.version(request.GetVersion()) != nil
+	return &inference.ModelReadyResponse{Ready: ready}, nil
+}
+
+func (s *inferenceServer) ServerMetadata(ctx context.Context, request *inference.ServerMetadataRequest) (*inference.ServerMetadataResponse, error) {
+	return &inference.ServerMetadataResponse{
+		Name:       inferenceServerName,
+		Version:    "2",
+		Extensions: []string{},
+	}, nil
+}
+
+func (s *inferenceServer) ModelMetadata(ctx context.Context, request *inference.ModelMetadataRequest) (*inference.ModelMetadataResponse, error) {
+	m := s.registry.get(request.GetName())
+	if m == nil {
+		return nil, status.Errorf(codes.NotFound, "model %q is not loaded", request.GetName())
+	}
+	versions := m.versionNames()
+	if request.GetVersion() != "" {
+		if m.version(request.GetVersion()) == nil {
+			return nil, status.Errorf(codes.NotFound, "model %q has no version %q", m.config.Name, request.GetVersion())
+		}
+		versions = []string{request.GetVersion()}
+	}
+	return &inference.ModelMetadataResponse{
+		Name:     m.config.Name,
+		Versions: versions,
+		Platform: inferencePlatform,
+		Inputs: []*inference.ModelMetadataResponse_TensorMetadata{
+			{Name: promptTensor, Datatype: bytesDatatype, Shape: []int64{-1}},
+		},
+		Outputs: []*inference.ModelMetadataResponse_TensorMetadata{
+			{Name: resultTensor, Datatype: bytesDatatype, Shape: []int64{-1}},
+		},
+	}, nil
+}
+
+func (s *inferenceServer) ModelInfer(ctx context.Context, request *inference.ModelInferRequest) (*inference.ModelInferResponse, error) {
+	prompts, raw, err := inferPrompts(request)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	version, err := s.registry.routeVersion(ctx, request.GetModelName(), request.GetModelVersion())
+	if err != nil {
+		return nil, err
+	}
+	defer version.release()
+
+	results := make([][]byte, 0, len(prompts))
+	for _, prompt := range prompts {
+		result, err := version.backend.Score(ctx, prompt, nil)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, []byte(result))
+	}
+
+	output := &inference.ModelInferResponse_InferOutputTensor{
+		Name:     resultTensor,
+		Datatype: bytesDatatype,
+		Shape:    []int64{int64(len(results))},
+	}
+	response := &inference.ModelInferResponse{
+		ModelName:    version.model,
+		ModelVersion: version.name,
+		Id:           request.GetId(),
+		Outputs:      []*inference.ModelInferResponse_InferOutputTensor{output},
+	}
+	if raw {
+		response.RawOutputContents = [][]byte{encodeBytesTensor(results)}
+	} else {
+		output.Contents = &inference.InferTensorContents{BytesContents: results}
+	}
+	return response, nil
+}
+
+// inferPrompts extracts the prompt tensor from a request, reporting whether it
+// was sent in raw_input_contents so the response can mirror the encoding.
+func inferPrompts(request *inference.ModelInferRequest) ([]string, bool, error) {
+	for i, input := range request.GetInputs() {
+		if input.GetName() != promptTensor && len(request.GetInputs()) > 1 {
+			continue
+		}
+		if input.GetDatatype() != bytesDatatype {
+			return nil, false, fmt.Errorf("input %q must be %s, got %s", input.GetName(), bytesDatatype, input.GetDatatype())
+		}
+
+		var elements [][]byte
+		raw := len(request.GetRawInputContents()) > 0
+		if raw {
+			if i >= len(request.GetRawInputContents()) {
+				return nil, false, fmt.Errorf("input %q has no raw contents", input.GetName())
+			}
+			decoded, err := decodeBytesTensor(request.GetRawInputContents()[i])
+			if err != nil {
+				return nil, false, fmt.Errorf("input %q: %v", input.GetName(), err)
+			}
+			elements = decoded
+		} else {
+			elements = input.GetContents().GetBytesContents()
+		}
+		if expected := elementCount(input.GetShape()); expected >= 0 && expected != int64(len(elements)) {
+			return nil, false, fmt.Errorf("input %q has shape %v but %d elements", input.GetName(), input.GetShape(), len(elements))
+		}
+
+		prompts := make([]string, len(elements))
+		for j, element := range elements {
+			prompts[j] = string(element)
+		}
+		return prompts, raw, nil
+	}
+	return nil, false, fmt.Errorf("request has no %q input", promptTensor)
+}
+
+func elementCount(shape []int64) int64 {
+	if len(shape) == 0 {
+		return -1
+	}
+	count := int64(1)
+	for _, dim := range shape {
+		count *= dim
+	}
+	return count
+}
+
+// decodeBytesTensor splits a raw BYTES tensor, where each element is prefixed
+// with its length as a 4-byte little-endian integer.
+func decodeBytesTensor(data []byte) ([][]byte, error) {
+	var elements [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated element length")
+		}
+		size := binary.LittleEndian.Uint32(data)
+		data = data[4:]
+		if uint32(len(data)) < size {
+			return nil, fmt.Errorf("truncated element of %d bytes", size)
+		}
+		elements = append(elements, data[:size])
+		data = data[size:]
+	}
+	return elements, nil
+}
+
+func encodeBytesTensor(elements [][]byte) []byte {
+	var data []byte
+	for _, element := range elements {
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(element)))
+		data = append(data, size[:]...)
+		data = append(data, element...)
+	}
+	return data
+}
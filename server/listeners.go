@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// mergedListener accepts connections from several listeners, letting one
+// server handle connections that cmux matched with different matchers.
+type mergedListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	closeOnce sync.Once
+}
+
+func muxListener(listeners ...net.Listener) net.Listener {
+	merged := &mergedListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error, len(listeners)),
+	}
+	for _, listener := range listeners {
+		go merged.accept(listener)
+	}
+	return merged
+}
+
+func (m *mergedListener) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			m.errs <- err
+			return
+		}
+		m.conns <- conn
+	}
+}
+
+func (m *mergedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case err := <-m.errs:
+		return nil, err
+	}
+}
+
+func (m *mergedListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		for _, listener := range m.listeners {
+			if closeErr := listener.Close(); closeErr != nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (m *mergedListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
+
+// settingsAckListener wraps HTTP/2 connections that fell through the gRPC
+// matcher. That matcher sent its own SETTINGS frame to elicit the client's
+// headers, so the client's first SETTINGS ACK answers cmux rather than the
+// HTTP/2 server, which would otherwise treat it as a protocol error.
+type settingsAckListener struct {
+	net.Listener
+}
+
+func (l settingsAckListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &settingsAckConn{Conn: conn, skip: len(http2.ClientPreface)}, nil
+}
+
+const (
+	http2FrameHeaderLen = 9
+	http2SettingsFrame  = 0x4
+	http2AckFlag        = 0x1
+)
+
+// settingsAckConn drops the first SETTINGS ACK frame the client sends.
+type settingsAckConn struct {
+	net.Conn
+	// skip counts bytes still to pass through before the next frame header.
+	skip    int
+	header  []byte
+	dropped bool
+	pending []byte
+}
+
+func (c *settingsAckConn) Read(p []byte) (int, error) {
+	for !c.dropped {
+		if len(c.pending) > 0 {
+			n := copy(p, c.pending)
+			c.pending = c.pending[n:]
+			return n, nil
+		}
+		buffer := make([]byte, len(p))
+		n, err := c.Conn.Read(buffer)
+		c.pending = c.filter(buffer[:n])
+		if err != nil {
+			if len(c.pending) > 0 {
+				n := copy(p, c.pending)
+				c.pending = c.pending[n:]
+				return n, nil
+			}
+			return 0, err
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// filter walks frame boundaries in data, removing the first SETTINGS ACK.
+func (c *settingsAckConn) filter(data []byte) []byte {
+	var out []byte
+	for len(data) > 0 && !c.dropped {
+		if c.skip > 0 {
+			n := c.skip
+			if n > len(data) {
+				n = len(data)
+			}
+			out = append(out, data[:n]...)
+			data = data[n:]
+			c.skip -= n
+			continue
+		}
+		need := http2FrameHeaderLen - len(c.header)
+		if need > len(data) {
+			need = len(data)
+		}
+		c.header = append(c.header, data[:need]...)
+		data = data[need:]
+		if len(c.header) < http2FrameHeaderLen {
+			continue
+		}
+		length := int(c.header[0])<<16 | int(c.header[1])<<8 | int(c.header[2])
+		if c.header[3] == http2SettingsFrame && c.header[4]&http2AckFlag != 0 {
+			c.dropped = true
+		} else {
+			out = append(out, c.header...)
+			c.skip = length
+		}
+		c.header = nil
+	}
+	return append(out, data...)
+}
+
+const unrecognizedBody = "unrecognized protocol: expected HTTP/1.1, HTTP/2 or gRPC\n"
+
+var unrecognizedResponse = fmt.Sprintf("HTTP/1.1 400 Bad Request\r\n"+
+	"Content-Type: text/plain; charset=utf-8\r\n"+
+	"Connection: close\r\n"+
+	"Content-Length: %d\r\n\r\n%s", len(unrecognizedBody), unrecognizedBody)
+
+// rejectUnrecognized answers connections no matcher recognized with a 400 and
+// closes them, instead of leaving the client waiting on a protocol error.
+func rejectUnrecognized(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			errorf("While rejecting unrecognized connections: %v", err)
+			return
+		}
+		warningf("Rejecting unrecognized protocol from %v", conn.RemoteAddr())
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(unrecognizedResponse))
+		conn.Close()
+	}
+}
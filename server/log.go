@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+var logLevelName = flag.String("log-level", "debug", "Least severe messages logged: debug, info, warning or error")
+
+// logLevel orders log messages by severity. Per-call messages are debug, so
+// operators can quiet a busy server at runtime through the admin API.
+type logLevel int32
+
+const (
+	debugLevel logLevel = iota
+	infoLevel
+	warningLevel
+	errorLevel
+)
+
+var logLevelNames = []string{"debug", "info", "warning", "error"}
+
+var currentLogLevel int32
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(name string) (logLevel, error) {
+	for level, levelName := range logLevelNames {
+		if name == levelName {
+			return logLevel(level), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+func setLogLevel(level logLevel) {
+	atomic.StoreInt32(&currentLogLevel, int32(level))
+}
+
+func getLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&currentLogLevel))
+}
+
+func logf(level logLevel, format string, args ...interface{}) {
+	if level >= getLogLevel() {
+		log.Output(3, fmt.Sprintf(format, args...))
+	}
+}
+
+func debugf(format string, args ...interface{})   { logf(debugLevel, format, args...) }
+func infof(format string, args ...interface{})    { logf(infoLevel, format, args...) }
+func warningf(format string, args ...interface{}) { logf(warningLevel, format, args...) }
+func errorf(format string, args ...interface{})   { logf(errorLevel, format, args...) }
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultModelName = "default"
+
+	tenantHeader        = "x-tenant"
+	sessionHeader       = "x-session-id"
+	requestIDHeader     = "x-request-id"
+	modelHeader         = "x-model"
+	modelVersionHeader  = "x-model-version"
+	streamSessionHeader = "x-stream-session"
+	chatSessionHeader   = "x-chat-session"
+	faultHeader         = "x-fault"
+)
+
+// modelConfig describes a model, its live versions and how traffic is split
+// between them.
+type modelConfig struct {
+	Name     string          `json:"name"`
+	Versions []versionConfig `json:"versions"`
+	Rules    []routeRule     `json:"rules,omitempty"`
+	// Sticky is "session" or "request": the metadata key hashed to keep a
+	// caller on the same version. Without a key the split is random.
+	Sticky string `json:"sticky,omitempty"`
+}
+
+type versionConfig struct {
+	Name    string        `json:"name"`
+	Weight  int           `json:"weight"`
+	Backend backendConfig `json:"backend"`
+}
+
+// routeRule pins matching requests to a version regardless of weights.
+type routeRule struct {
+	Tenants []string `json:"tenants,omitempty"`
+	Header  string   `json:"header,omitempty"`
+	Value   string   `json:"value,omitempty"`
+	Version string   `json:"version"`
+}
+
+type modelVersion struct {
+	model   string
+	name    string
+	weight  int
+	backend modelBackend
+	parent  *model
+}
+
+type model struct {
+	config      modelConfig
+	versions    []*modelVersion
+	totalWeight int
+
+	inFlight sync.WaitGroup
+	calls    int64
+}
+
+func newModel(config modelConfig) (*model, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("model has no name")
+	}
+	if len(config.Versions) == 0 {
+		return nil, fmt.Errorf("model %s has no versions", config.Name)
+	}
+	m := &model{config: config}
+	for _, versionConfig := range config.Versions {
+		backend, err := newBackend(versionConfig.Backend)
+		if err != nil {
+			return nil, fmt.Errorf("model %s version %s: %v", config.Name, versionConfig.Name, err)
+		}
+		if versionConfig.Weight < 0 {
+			return nil, fmt.Errorf("model %s version %s has a negative weight", config.Name, versionConfig.Name)
+		}
+		m.versions = append(m.versions, &modelVersion{
+			model:   config.Name,
+			name:    versionConfig.Name,
+			weight:  versionConfig.Weight,
+			backend: backend,
+			parent:  m,
+		})
+		m.totalWeight += versionConfig.Weight
+	}
+	for _, rule := range config.Rules {
+		if m.version(rule.Version) == nil {
+			return nil, fmt.Errorf("model %s routes to unknown version %s", config.Name, rule.Version)
+		}
+	}
+	if m.totalWeight == 0 && len(config.Rules) == 0 {
+		return nil, fmt.Errorf("model %s has no weighted versions", config.Name)
+	}
+	return m, nil
+}
+
+func (m *model) versionNames() []string {
+	names := make([]string, 0, len(m.versions))
+	for _, v := range m.versions {
+		names = append(names, v.name)
+	}
+	return names
+}
+
+func (m *model) active() int64 {
+	return atomic.LoadInt64(&m.calls)
+}
+
+func (m *model) version(name string) *modelVersion {
+	for _, v := range m.versions {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// pick chooses the version serving a request from its incoming metadata.
+func (m *model) pick(md metadata.MD) *modelVersion {
+	for _, rule := range m.config.Rules {
+		if rule.matches(md) {
+			return m.version(rule.Version)
+		}
+	}
+	if m.totalWeight == 0 {
+		return nil
+	}
+
+	var slot int
+	key := ""
+	switch m.config.Sticky {
+	case "session":
+		key = firstValue(md, sessionHeader)
+	case "request":
+		key = firstValue(md, requestIDHeader)
+	}
+	if key != "" {
+		hash := fnv.New32a()
+		hash.Write([]byte(m.config.Name + "/" + key))
+		slot = int(hash.Sum32() % uint32(m.totalWeight))
+	} else {
+		slot = rand.Intn(m.totalWeight)
+	}
+	for _, v := range m.versions {
+		if slot < v.weight {
+			return v
+		}
+		slot -= v.weight
+	}
+	return m.versions[len(m.versions)-1]
+}
+
+func (r routeRule) matches(md metadata.MD) bool {
+	if len(r.Tenants) > 0 {
+		tenant := firstValue(md, tenantHeader)
+		for _, t := range r.Tenants {
+			if t == tenant {
+				return true
+			}
+		}
+	}
+	if r.Header != "" {
+		for _, value := range md.Get(r.Header) {
+			if r.Value == "" || value == r.Value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func firstValue(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Model load states reported through the health endpoints.
+const (
+	modelLoading  = "loading"
+	modelReady    = "ready"
+	modelFailed   = "failed"
+	modelDraining = "draining"
+)
+
+// modelStatus is the externally visible load state of a model.
+type modelStatus struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	Versions []string  `json:"versions,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	InFlight int64     `json:"inFlight"`
+	Updated  time.Time `json:"updated"`
+}
+
+// modelRegistry holds the models served by this process. Models are replaced
+// as a whole, so calls that already resolved a version keep using it until
+// they finish.
+type modelRegistry struct {
+	mu          sync.RWMutex
+	models      map[string]*model
+	statuses    map[string]*modelStatus
+	subscribers []func(modelStatus)
+}
+
+func newModelRegistry() *modelRegistry {
+	return &modelRegistry{
+		models:   map[string]*model{},
+		statuses: map[string]*modelStatus{},
+	}
+}
+
+func (r *modelRegistry) add(config modelConfig) error {
+	return r.load(config, "")
+}
+
+// load builds a model from its config and swaps it in, draining the version
+// it replaces. A model being reloaded stays ready and keeps serving until the
+// swap, and a failed load leaves it serving.
+func (r *modelRegistry) load(config modelConfig, source string) error {
+	r.setStatus(config.Name, func(status *modelStatus) {
+		if r.models[config.Name] == nil {
+			status.State = modelLoading
+		}
+		status.Source = source
+		status.Error = ""
+	})
+	m, err := newModel(config)
+	if err != nil {
+		r.fail(config.Name, source, err)
+		return err
+	}
+
+	r.mu.Lock()
+	previous := r.models[config.Name]
+	r.models[config.Name] = m
+	r.mu.Unlock()
+	r.setStatus(config.Name, func(status *modelStatus) {
+		status.State = modelReady
+		status.Versions = m.versionNames()
+	})
+	if previous != nil {
+		go r.drain(config.Name, previous, false)
+	}
+	return nil
+}
+
+// fail records a model that could not be loaded. A previously loaded model
+// stays ready and keeps serving.
+func (r *modelRegistry) fail(name, source string, err error) {
+	r.setStatus(name, func(status *modelStatus) {
+		status.State = modelFailed
+		status.Source = source
+		status.Error = err.Error()
+		if r.models[name] != nil {
+			status.State = modelReady
+		}
+	})
+}
+
+// unload stops routing new calls to a model and forgets it once its in-flight
+// calls complete.
+func (r *modelRegistry) unload(name string) {
+	r.mu.Lock()
+	previous := r.models[name]
+	delete(r.models, name)
+	if previous == nil {
+		delete(r.statuses, name)
+	}
+	r.mu.Unlock()
+	if previous == nil {
+		r.notify(modelStatus{Name: name, Updated: time.Now()})
+		return
+	}
+	r.setStatus(name, func(status *modelStatus) {
+		status.State = modelDraining
+	})
+	go r.drain(name, previous, true)
+}
+
+func (r *modelRegistry) drain(name string, m *model, forget bool) {
+	m.inFlight.Wait()
+	infof("Model %s drained versions %v", name, m.versionNames())
+	if !forget {
+		return
+	}
+	r.mu.Lock()
+	removed := r.models[name] == nil
+	if removed {
+		delete(r.statuses, name)
+	}
+	r.mu.Unlock()
+	if removed {
+		r.notify(modelStatus{Name: name, Updated: time.Now()})
+	}
+}
+
+func (r *modelRegistry) setStatus(name string, update func(*modelStatus)) {
+	r.mu.Lock()
+	status, ok := r.statuses[name]
+	if !ok {
+		status = &modelStatus{Name: name}
+		r.statuses[name] = status
+	}
+	update(status)
+	status.Updated = time.Now()
+	current := *status
+	r.mu.Unlock()
+	r.notify(current)
+}
+
+func (r *modelRegistry) notify(status modelStatus) {
+	r.mu.RLock()
+	subscribers := r.subscribers
+	r.mu.RUnlock()
+	for _, subscriber := range subscribers {
+		subscriber(status)
+	}
+}
+
+// subscribe calls fn with the current state of every model and again on each
+// change. A status with an empty State means the model was removed.
+func (r *modelRegistry) subscribe(fn func(modelStatus)) {
+	r.mu.Lock()
+	r.subscribers = append(r.subscribers, fn)
+	r.mu.Unlock()
+	for _, status := range r.list() {
+		fn(status)
+	}
+}
+
+// list returns the load state of every known model.
+func (r *modelRegistry) list() []modelStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	statuses := make([]modelStatus, 0, len(r.statuses))
+	for name, status := range r.statuses {
+		current := *status
+		if m := r.models[name]; m != nil {
+			current.InFlight = m.active()
+		}
+		statuses = append(statuses, current)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// loadModelConfig reads a JSON array of model configs into the registry and
+// unloads the models an earlier load of the file added that it no longer
+// lists.
+func (r *modelRegistry) loadModelConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var configs []modelConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	listed := map[string]bool{}
+	for _, config := range configs {
+		listed[config.Name] = true
+		if err := r.load(config, path); err != nil {
+			return err
+		}
+	}
+
+	var removed []string
+	r.mu.RLock()
+	for name, status := range r.statuses {
+		if status.Source == path && !listed[name] && r.models[name] != nil {
+			removed = append(removed, name)
+		}
+	}
+	r.mu.RUnlock()
+	for _, name := range removed {
+		infof("Model %s removed from %s, unloading", name, path)
+		r.unload(name)
+	}
+	return nil
+}
+
+func (r *modelRegistry) get(name string) *model {
+	if name == "" {
+		name = defaultModelName
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.models[name]
+}
+
+// route resolves the model version serving a request. The caller must call
+// release on the returned version once the call completes so that a replaced
+// model can finish draining.
+func (r *modelRegistry) route(ctx context.Context, modelName string) (*modelVersion, error) {
+	m, err := r.acquire(modelName)
+	if err != nil {
+		return nil, err
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := m.pick(md)
+	if v == nil {
+		m.done()
+		return nil, status.Errorf(codes.Unavailable, "model %q has no version for this request", m.config.Name)
+	}
+	return v, nil
+}
+
+// routeVersion resolves an explicitly requested version, bypassing the
+// traffic split. An empty version falls back to route.
+func (r *modelRegistry) routeVersion(ctx context.Context, modelName, versionName string) (*modelVersion, error) {
+	if versionName == "" {
+		return r.route(ctx, modelName)
+	}
+	m, err := r.acquire(modelName)
+	if err != nil {
+		return nil, err
+	}
+	v := m.version(versionName)
+	if v == nil {
+		m.done()
+		return nil, status.Errorf(codes.NotFound, "model %q has no version %q", m.config.Name, versionName)
+	}
+	return v, nil
+}
+
+// acquire looks up a model and counts the caller as in flight on it.
+func (r *modelRegistry) acquire(modelName string) (*model, error) {
+	if modelName == "" {
+		modelName = defaultModelName
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	m := r.models[modelName]
+	if m == nil {
+		return nil, status.Errorf(codes.NotFound, "model %q is not loaded", modelName)
+	}
+	m.inFlight.Add(1)
+	atomic.AddInt64(&m.calls, 1)
+	return m, nil
+}
+
+// release marks a call routed to this version as complete.
+func (v *modelVersion) release() {
+	v.parent.done()
+}
+
+func (m *model) done() {
+	atomic.AddInt64(&m.calls, -1)
+	m.inFlight.Done()
+}
+
+// header is the response metadata reporting which version served a call.
+func (v *modelVersion) header() metadata.MD {
+	return metadata.Pairs(modelHeader, v.model, modelVersionHeader, v.name)
+}
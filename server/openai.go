@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	pb "azuremachinelearning.com/scorer"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// openAIHandler serves OpenAI-compatible completions, chat completions and
+// model listing on top of the same backends as the Scorer service.
+type openAIHandler struct {
+	registry *modelRegistry
+}
+
+func registerOpenAIHandlers(mux *http.ServeMux, registry *modelRegistry) {
+	h := &openAIHandler{registry: registry}
+	mux.HandleFunc("/v1/models", h.models)
+	mux.HandleFunc("/v1/completions", h.completions)
+	mux.HandleFunc("/v1/chat/completions", h.chatCompletions)
+}
+
+type completionRequest struct {
+	Model         string          `json:"model"`
+	Prompt        json.RawMessage `json:"prompt"`
+	Messages      []chatMessage   `json:"messages"`
+	MaxTokens     int             `json:"max_tokens"`
+	Temperature   float32         `json:"temperature"`
+	Seed          int64           `json:"seed"`
+	Stream        bool            `json:"stream"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+}
+
+// parameters passes the request's sampling settings on to the backend.
+func (r *completionRequest) parameters() *pb.GenerationParameters {
+	return &pb.GenerationParameters{Temperature: r.Temperature, MaxTokens: int32(r.MaxTokens), Seed: r.Seed}
+}
+
+type chatMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type completionChoice struct {
+	Index        int          `json:"index"`
+	Text         *string      `json:"text,omitempty"`
+	Message      *chatMessage `json:"message,omitempty"`
+	Delta        *chatMessage `json:"delta,omitempty"`
+	Logprobs     interface{}  `json:"logprobs"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+type completionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type completionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []completionChoice `json:"choices"`
+	Usage   *completionUsage   `json:"usage,omitempty"`
+}
+
+type openAIError struct {
+	Message string      `json:"message"`
+	Type    string      `json:"type"`
+	Param   interface{} `json:"param"`
+	Code    interface{} `json:"code"`
+}
+
+func (h *openAIHandler) models(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "only GET is supported", nil)
+		return
+	}
+	type modelObject struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		OwnedBy string `json:"owned_by"`
+	}
+	data := []modelObject{}
+	for _, status := range h.registry.list() {
+		if status.State != modelReady {
+			continue
+		}
+		data = append(data, modelObject{ID: status.Name, Object: "model", Created: status.Updated.Unix(), OwnedBy: inferenceServerName})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"object": "list", "data": data})
+}
+
+func (h *openAIHandler) completions(w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeCompletionRequest(w, r)
+	if !ok {
+		return
+	}
+	var prompt string
+	if err := json.Unmarshal(request.Prompt, &prompt); err != nil {
+		var prompts []string
+		if err := json.Unmarshal(request.Prompt, &prompts); err != nil || len(prompts) != 1 {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "prompt must be a string or a single-element array of strings", "prompt")
+			return
+		}
+		prompt = prompts[0]
+	}
+	h.complete(w, r, request, prompt, false)
+}
+
+func (h *openAIHandler) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeCompletionRequest(w, r)
+	if !ok {
+		return
+	}
+	if len(request.Messages) == 0 {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "messages must not be empty", "messages")
+		return
+	}
+	h.complete(w, r, request, chatPrompt(request.Messages), true)
+}
+
+// chatPrompt flattens a conversation into a single prompt ending with the
+// assistant turn to be generated.
+func chatPrompt(messages []chatMessage) string {
+	var prompt strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&prompt, "%s: %s\n", message.Role, message.Content)
+	}
+	prompt.WriteString("assistant:")
+	return prompt.String()
+}
+
+func decodeCompletionRequest(w http.ResponseWriter, r *http.Request) (*completionRequest, bool) {
+	if r.Method != http.MethodPost {
+		writeOpenAIError(w, http.StatusMethodNotAllowed, "invalid_request_error", "only POST is supported", nil)
+		return nil, false
+	}
+	var request completionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("could not parse request body: %v", err), nil)
+		return nil, false
+	}
+	return &request, true
+}
+
+func (h *openAIHandler) complete(w http.ResponseWriter, r *http.Request, request *completionRequest, prompt string, chat bool) {
+	ctx := incomingContext(r)
+	version, err := h.registry.route(ctx, request.Model)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	defer version.release()
+	w.Header().Set(modelHeader, version.model)
+	w.Header().Set(modelVersionHeader, version.name)
+	debugf("OpenAI %s for %s/%s stream=%v", r.URL.Path, version.model, version.name, request.Stream)
+
+	object, prefix := "text_completion", "cmpl-"
+	if chat {
+		object, prefix = "chat.completion", "chatcmpl-"
+	}
+	response := completionResponse{
+		ID:      fmt.Sprintf("%s%016x", prefix, rand.Uint64()),
+		Object:  object,
+		Created: time.Now().Unix(),
+		Model:   version.model,
+	}
+	promptTokens := countTokens(prompt)
+	ctx, truncated := withTruncation(ctx)
+
+	if !request.Stream {
+		result, err := version.backend.Score(ctx, prompt, request.parameters())
+		if err != nil {
+			writeStatusError(w, err)
+			return
+		}
+		result, finish := truncateTokens(result, request.MaxTokens)
+		if truncated() {
+			finish = "length"
+		}
+		choice := completionChoice{FinishReason: &finish}
+		if chat {
+			choice.Message = &chatMessage{Role: "assistant", Content: result}
+		} else {
+			choice.Text = &result
+		}
+		response.Choices = []completionChoice{choice}
+		completionTokens := countTokens(result)
+		response.Usage = &completionUsage{promptTokens, completionTokens, promptTokens + completionTokens}
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "streaming is not supported on this connection", nil)
+		return
+	}
+	if chat {
+		response.Object = "chat.completion.chunk"
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(choice completionChoice) error {
+		response.Choices = []completionChoice{choice}
+		data, err := json.Marshal(response)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if chat {
+		send(completionChoice{Delta: &chatMessage{Role: "assistant"}})
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	completionTokens, finish := 0, "stop"
+	err = version.backend.StreamScore(streamCtx, prompt, request.parameters(), func(chunk string) error {
+		if request.MaxTokens > 0 && completionTokens >= request.MaxTokens {
+			finish = "length"
+			cancel()
+			return context.Canceled
+		}
+		chunk, reason := truncateTokens(chunk, request.MaxTokens-completionTokens)
+		completionTokens += countTokens(chunk)
+		choice := completionChoice{}
+		if chat {
+			choice.Delta = &chatMessage{Content: chunk}
+		} else {
+			choice.Text = &chunk
+		}
+		if err := send(choice); err != nil {
+			return err
+		}
+		if reason == "length" {
+			finish = reason
+			cancel()
+			return context.Canceled
+		}
+		return nil
+	})
+	if err == nil && truncated() {
+		finish = "length"
+	}
+	if err != nil && finish != "length" {
+		warningf("OpenAI stream for %s/%s ended early: %v", version.model, version.name, err)
+		data, _ := json.Marshal(map[string]openAIError{"error": statusToOpenAIError(err)})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+		return
+	}
+
+	final := completionChoice{FinishReason: &finish}
+	if chat {
+		final.Delta = &chatMessage{}
+	} else {
+		empty := ""
+		final.Text = &empty
+	}
+	send(final)
+	if request.StreamOptions != nil && request.StreamOptions.IncludeUsage {
+		response.Choices = []completionChoice{}
+		response.Usage = &completionUsage{promptTokens, completionTokens, promptTokens + completionTokens}
+		data, _ := json.Marshal(response)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
+
+// incomingContext exposes HTTP request headers as incoming gRPC metadata so
+// model routing rules apply to HTTP callers too.
+func incomingContext(r *http.Request) context.Context {
+	md := metadata.MD{}
+	for key, values := range r.Header {
+		md.Append(strings.ToLower(key), values...)
+	}
+	return metadata.NewIncomingContext(r.Context(), md)
+}
+
+// countTokens approximates the token count by splitting on whitespace.
+func countTokens(text string) int {
+	return len(strings.Fields(text))
+}
+
+// truncateTokens limits text to max whitespace-separated tokens, returning the
+// OpenAI finish reason.
+func truncateTokens(text string, max int) (string, string) {
+	if max <= 0 {
+		return text, "stop"
+	}
+	tokens := strings.Fields(text)
+	if len(tokens) <= max {
+		return text, "stop"
+	}
+	return strings.Join(tokens[:max], " "), "length"
+}
+
+func statusToOpenAIError(err error) openAIError {
+	s := status.Convert(err)
+	errorType := "server_error"
+	switch s.Code() {
+	case codes.InvalidArgument, codes.NotFound, codes.FailedPrecondition:
+		errorType = "invalid_request_error"
+	case codes.ResourceExhausted:
+		errorType = "rate_limit_error"
+	}
+	return openAIError{Message: s.Message(), Type: errorType, Code: snakeCase(s.Code().String())}
+}
+
+func writeStatusError(w http.ResponseWriter, err error) {
+	writeJSON(w, httpStatusFromCode(status.Code(err)), map[string]openAIError{"error": statusToOpenAIError(err)})
+}
+
+func writeOpenAIError(w http.ResponseWriter, code int, errorType, message string, param interface{}) {
+	writeJSON(w, code, map[string]openAIError{"error": {Message: message, Type: errorType, Param: param}})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// snakeCase converts a gRPC code name such as NotFound to not_found.
+func snakeCase(name string) string {
+	var out strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				out.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
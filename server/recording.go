@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"azuremachinelearning.com/scorer/capture"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	recordPath     = flag.String("record", "", "JSON Lines file Scorer calls are recorded to for replay, empty disables recording")
+	recordSample   = flag.Float64("record-sample", 1, "Fraction of Scorer calls recorded")
+	recordMaxBytes = flag.Int64("record-max-bytes", 100<<20, "Size at which the recording file is rotated")
+	recordMaxFiles = flag.Int("record-max-files", 5, "Rotated recording files kept")
+	recordRedact   = flag.String("record-redact", "authorization,cookie,x-api-key", "Comma-separated metadata keys and message fields whose values are not recorded")
+)
+
+var recordMetrics = expvar.NewMap("recording")
+
+const recordedService = "/scorer.Scorer/"
+
+// recorder captures sampled Scorer calls, every message with its timing
+// included, so the client can replay real traffic against another server.
+type recorder struct {
+	writer *capture.Writer
+	sample float64
+	redact map[string]bool
+}
+
+func newRecorder(path string) (*recorder, error) {
+	writer, err := capture.NewWriter(path, *recordMaxBytes, *recordMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	r := &recorder{writer: writer, sample: *recordSample, redact: map[string]bool{}}
+	for _, key := range strings.Split(*recordRedact, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			r.redact[strings.ToLower(key)] = true
+		}
+	}
+	return r, nil
+}
+
+func (r *recorder) records(method string) bool {
+	if !strings.HasPrefix(method, recordedService) {
+		return false
+	}
+	if r.sample < 1 && rand.Float64() >= r.sample {
+		recordMetrics.Add("sampled_out", 1)
+		return false
+	}
+	return true
+}
+
+func (r *recorder) unaryInterceptor(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !r.records(info.FullMethod) {
+		return handler(ctx, request)
+	}
+	call := r.start(ctx, info.FullMethod)
+	call.message(capture.Request, request)
+	transport := &recordingTransport{ServerTransportStream: grpc.ServerTransportStreamFromContext(ctx), call: call}
+	response, err := handler(grpc.NewContextWithServerTransportStream(ctx, transport), request)
+	if err == nil {
+		call.message(capture.Response, response)
+	}
+	r.finish(call, err)
+	return response, err
+}
+
+func (r *recorder) streamInterceptor(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !r.records(info.FullMethod) {
+		return handler(server, stream)
+	}
+	call := r.start(stream.Context(), info.FullMethod)
+	err := handler(server, &recordingStream{ServerStream: stream, call: call})
+	r.finish(call, err)
+	return err
+}
+
+// recordedCall collects a call's record. Messages of full-duplex streams are
+// added from both directions at once.
+type recordedCall struct {
+	mu       sync.Mutex
+	recorder *recorder
+	record   capture.Record
+}
+
+func (r *recorder) start(ctx context.Context, method string) *recordedCall {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return &recordedCall{recorder: r, record: capture.Record{
+		ID:       newSessionID(),
+		Method:   method,
+		Start:    time.Now(),
+		Metadata: r.redactMetadata(md),
+	}}
+}
+
+func (r *recorder) finish(call *recordedCall, err error) {
+	call.mu.Lock()
+	call.record.Duration = time.Since(call.record.Start)
+	call.record.Code = status.Code(err).String()
+	if err != nil {
+		call.record.Error = status.Convert(err).Message()
+	}
+	call.mu.Unlock()
+
+	rotated, err := r.writer.Write(&call.record)
+	if err != nil {
+		errorf("Could not record %s: %v", call.record.Method, err)
+		recordMetrics.Add("errors", 1)
+		return
+	}
+	if rotated {
+		recordMetrics.Add("rotations", 1)
+	}
+	recordMetrics.Add("recorded", 1)
+}
+
+func (c *recordedCall) message(direction string, m interface{}) {
+	message, ok := m.(proto.Message)
+	if !ok {
+		return
+	}
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(message)
+	if err != nil {
+		return
+	}
+	data = c.recorder.redactMessage(data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record.Messages = append(c.record.Messages, capture.Message{
+		Direction: direction,
+		Offset:    time.Since(c.record.Start),
+		Message:   data,
+	})
+}
+
+func (c *recordedCall) header(md metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record.Header = metadata.Join(c.record.Header, c.recorder.redactMetadata(md))
+}
+
+func (r *recorder) redactMetadata(md metadata.MD) metadata.MD {
+	redacted := metadata.MD{}
+	for key, values := range md {
+		if r.redact[key] {
+			values = []string{capture.Redacted}
+		}
+		redacted[key] = values
+	}
+	return redacted
+}
+
+// redactMessage blanks redacted top-level fields of a JSON message.
+func (r *recorder) redactMessage(data []byte) []byte {
+	if len(r.redact) == 0 {
+		return data
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data
+	}
+	changed := false
+	for name := range fields {
+		if r.redact[strings.ToLower(name)] {
+			fields[name], changed = json.RawMessage(`"`+capture.Redacted+`"`), true
+		}
+	}
+	if !changed {
+		return data
+	}
+	redacted, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return redacted
+}
+
+// recordingStream records the messages and headers of a streaming call.
+type recordingStream struct {
+	grpc.ServerStream
+	call *recordedCall
+}
+
+func (s *recordingStream) SetHeader(md metadata.MD) error {
+	s.call.header(md)
+	return s.ServerStream.SetHeader(md)
+}
+
+func (s *recordingStream) SendHeader(md metadata.MD) error {
+	s.call.header(md)
+	return s.ServerStream.SendHeader(md)
+}
+
+func (s *recordingStream) SendMsg(m interface{}) error {
+	s.call.message(capture.Response, m)
+	return s.ServerStream.SendMsg(m)
+}
+
+func (s *recordingStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.call.message(capture.Request, m)
+	}
+	return err
+}
+
+// recordingTransport records the headers a unary handler sets through
+// grpc.SetHeader.
+type recordingTransport struct {
+	grpc.ServerTransportStream
+	call *recordedCall
+}
+
+func (t *recordingTransport) SetHeader(md metadata.MD) error {
+	t.call.header(md)
+	return t.ServerTransportStream.SetHeader(md)
+}
+
+func (t *recordingTransport) SendHeader(md metadata.MD) error {
+	t.call.header(md)
+	return t.ServerTransportStream.SendHeader(md)
+}
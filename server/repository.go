@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const manifestSuffix = ".json"
+
+// modelRepository keeps the registry in sync with a directory holding one
+// manifest per model. A manifest is a modelConfig; its name defaults to the
+// file name without the .json suffix.
+type modelRepository struct {
+	dir      string
+	registry *modelRegistry
+
+	mu sync.Mutex
+	// loaded maps manifest paths to the model name and content hash last applied.
+	loaded map[string]manifestState
+}
+
+type manifestState struct {
+	model string
+	hash  [sha256.Size]byte
+}
+
+func newModelRepository(dir string, registry *modelRegistry) *modelRepository {
+	return &modelRepository{
+		dir:      dir,
+		registry: registry,
+		loaded:   map[string]manifestState{},
+	}
+}
+
+// watch rescans the repository every interval until stop is closed.
+func (r *modelRepository) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := r.sync(); err != nil {
+				errorf("Could not scan model repository %s: %v", r.dir, err)
+			}
+		}
+	}
+}
+
+// sync loads new manifests, reloads changed ones and unloads models whose
+// manifest was removed.
+func (r *modelRepository) sync() error {
+	return r.scan(false)
+}
+
+// reload is sync that also reloads unchanged manifests.
+func (r *modelRepository) reload() error {
+	return r.scan(true)
+}
+
+func (r *modelRepository) scan(force bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	paths, err := filepath.Glob(filepath.Join(r.dir, "*"+manifestSuffix))
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, path := range paths {
+		seen[path] = true
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			errorf("Could not read model manifest %s: %v", path, err)
+			continue
+		}
+		hash := sha256.Sum256(data)
+		previous, known := r.loaded[path]
+		if known && previous.hash == hash && !force {
+			continue
+		}
+
+		config, err := parseManifest(path, data)
+		if err != nil {
+			errorf("Could not parse model manifest %s: %v", path, err)
+			r.registry.fail(config.Name, path, err)
+			r.loaded[path] = manifestState{model: config.Name, hash: hash}
+			continue
+		}
+		if known && previous.model != config.Name {
+			r.registry.unload(previous.model)
+		}
+		if err := r.registry.load(config, path); err != nil {
+			errorf("Could not load model %s from %s: %v", config.Name, path, err)
+		} else {
+			infof("Loaded model %s versions %v from %s", config.Name, versionNames(config), path)
+		}
+		r.loaded[path] = manifestState{model: config.Name, hash: hash}
+	}
+
+	for path, state := range r.loaded {
+		if seen[path] {
+			continue
+		}
+		infof("Model manifest %s removed, unloading %s", path, state.model)
+		r.registry.unload(state.model)
+		delete(r.loaded, path)
+	}
+	return nil
+}
+
+func parseManifest(path string, data []byte) (modelConfig, error) {
+	config := modelConfig{Name: strings.TrimSuffix(filepath.Base(path), manifestSuffix)}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return config, nil
+}
+
+func versionNames(config modelConfig) []string {
+	names := make([]string, 0, len(config.Versions))
+	for _, v := range config.Versions {
+		names = append(names, v.Name)
+	}
+	return names
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"flag"
+	"sync"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	resumeTTL         = flag.Duration("resume-ttl", 5*time.Minute, "How long a StreamingResponseScore session is kept for resuming once no client follows it, 0 disables resuming")
+	resumeGrace       = flag.Duration("resume-grace", 30*time.Second, "How long a StreamingResponseScore session keeps generating once no client follows it, 0 until the session expires")
+	resumeMaxBytes    = flag.Int("resume-max-bytes", 1<<20, "Size limit of the output a stream session keeps in bytes, beyond which delivered messages are dropped and then the stream fails")
+	resumeMaxSessions = flag.Int("resume-max-sessions", 10000, "Number of stream sessions kept at once, 0 disables resuming")
+)
+
+var sessionMetrics = expvar.NewMap("stream_sessions")
+
+// streamSessions keeps the output of StreamingResponseScore streams so a
+// client whose connection dropped can resume where it stopped. Generation
+// runs detached from the call that started it. It is stopped once nobody has
+// followed it for the grace period, and the session is forgotten after the
+// TTL.
+type streamSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*streamSession
+	ttl      time.Duration
+	grace    time.Duration
+	maxBytes int
+	max      int
+}
+
+type streamSession struct {
+	id     string
+	tenant string
+	header metadata.MD
+	output *flightStream
+	// followers, expiry and idle are guarded by the sessions mutex.
+	followers int
+	expiry    *time.Timer
+	idle      *time.Timer
+}
+
+func newStreamSessions(ttl, grace time.Duration, maxBytes, max int) *streamSessions {
+	return &streamSessions{sessions: map[string]*streamSession{}, ttl: ttl, grace: grace, maxBytes: maxBytes, max: max}
+}
+
+// start runs produce in a new session. Its output is kept until the session
+// expires, whether or not the caller stays to follow it.
+func (s *streamSessions) start(ctx context.Context, header metadata.MD, produce func(context.Context, func(string) error) error) (*streamSession, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := newSessionID()
+	generateCtx, cancel := context.WithCancel(context.Background())
+	session := &streamSession{
+		id:     id,
+		tenant: firstValue(md, tenantHeader),
+		header: metadata.Join(header, metadata.Pairs(streamSessionHeader, id)),
+		output: newFlightStream(generateCtx, cancel, s.maxBytes),
+	}
+
+	s.mu.Lock()
+	if len(s.sessions) >= s.max {
+		s.mu.Unlock()
+		cancel()
+		return nil, status.Errorf(codes.ResourceExhausted, "too many stream sessions, the limit is %d", s.max)
+	}
+	s.sessions[session.id] = session
+	s.expireLater(session)
+	s.mu.Unlock()
+	sessionMetrics.Add("started", 1)
+
+	go func() {
+		err := produce(generateCtx, session.output.append)
+		cancel()
+		session.output.finish(err)
+	}()
+	return session, nil
+}
+
+// get returns a live session started by the same tenant.
+func (s *streamSessions) get(ctx context.Context, id string) *streamSession {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := s.sessions[id]
+	if session == nil || session.tenant != firstValue(md, tenantHeader) {
+		return nil
+	}
+	return session
+}
+
+// follow sends a session's output after the first from messages, numbering
+// each message by its position in the stream. An operator cancelling the
+// call stops generation too.
+func (s *streamSessions) follow(ctx context.Context, session *streamSession, from int64, send func(*pb.InferenceResponse) error) error {
+	if err := session.output.check(from); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	session.followers++
+	for _, timer := range []*time.Timer{session.expiry, session.idle} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	session.expiry, session.idle = nil, nil
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		session.followers--
+		if session.followers == 0 {
+			s.expireLater(session)
+		}
+		s.mu.Unlock()
+	}()
+	onCancel(ctx, func() {
+		session.output.stop(status.Error(codes.Canceled, "call cancelled by an operator"))
+	})
+
+	return session.output.follow(ctx, from, func(result string, sequence int64) error {
+		return send(&pb.InferenceResponse{Result: result, Sequence: sequence})
+	})
+}
+
+// expireLater stops generation after the grace period and drops the session
+// after the TTL unless a follower attaches first. The caller holds the mutex.
+func (s *streamSessions) expireLater(session *streamSession) {
+	var timer *time.Timer
+	timer = time.AfterFunc(s.ttl, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if session.expiry != timer || session.followers > 0 {
+			return
+		}
+		delete(s.sessions, session.id)
+		session.output.cancel()
+		sessionMetrics.Add("expired", 1)
+	})
+	session.expiry = timer
+
+	if s.grace <= 0 || s.grace >= s.ttl {
+		return
+	}
+	var idle *time.Timer
+	idle = time.AfterFunc(s.grace, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if session.idle != idle || session.followers > 0 {
+			return
+		}
+		if session.output.stop(status.Errorf(codes.Aborted, "generation stopped after no client followed the stream for %v", s.grace)) {
+			sessionMetrics.Add("abandoned", 1)
+		}
+	})
+	session.idle = idle
+}
+
+func newSessionID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
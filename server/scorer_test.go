@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func echoModel(name, suffix string) modelConfig {
+	return modelConfig{
+		Name:     name,
+		Versions: []versionConfig{{Name: "v1", Weight: 100, Backend: backendConfig{Suffix: suffix, Interval: "5ms"}}},
+	}
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func checkCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != want {
+		t.Fatalf("Got status %s (%v), want %s", got, err, want)
+	}
+}
+
+func TestScore(t *testing.T) {
+	server := startTestServer(t, testModel, echoModel("rainy", "rainy"), echoModel("failing", ""))
+	server.setBackend(t, "failing", &funcBackend{score: func(ctx context.Context, prompt string) (string, error) {
+		return "", status.Error(codes.Internal, "model crashed")
+	}})
+
+	tests := []struct {
+		name    string
+		request *pb.InferenceRequest
+		want    string
+		version string
+		code    codes.Code
+	}{
+		{name: "default model", request: &pb.InferenceRequest{Prompt: "Today is"}, want: "Today is sunny", version: "default/v1"},
+		{name: "named model", request: &pb.InferenceRequest{Prompt: "Today is", Model: "rainy"}, want: "Today is rainy", version: "rainy/v1"},
+		{name: "unknown model", request: &pb.InferenceRequest{Prompt: "Today is", Model: "nope"}, code: codes.NotFound},
+		{name: "backend error", request: &pb.InferenceRequest{Prompt: "Today is", Model: "failing"}, code: codes.Internal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var header metadata.MD
+			response, err := server.client.Score(testContext(t), test.request, grpc.Header(&header))
+			checkCode(t, err, test.code)
+			if test.code != codes.OK {
+				return
+			}
+			if response.GetResult() != test.want {
+				t.Errorf("Got result %q, want %q", response.GetResult(), test.want)
+			}
+			if version := firstValue(header, modelHeader) + "/" + firstValue(header, modelVersionHeader); version != test.version {
+				t.Errorf("Served by %s, want %s", version, test.version)
+			}
+		})
+	}
+}
+
+func TestStreamingRequestScore(t *testing.T) {
+	server := startTestServer(t)
+	tests := []struct {
+		name    string
+		prompts []string
+		want    string
+	}{
+		{name: "no prompts", want: "START  END"},
+		{name: "one prompt", prompts: []string{"a"}, want: "START __a END"},
+		{name: "several prompts", prompts: []string{"a", "b", "c"}, want: "START __a__b__c END"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream, err := server.client.StreamingRequestScore(testContext(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, prompt := range test.prompts {
+				if err := stream.Send(&pb.InferenceRequest{Prompt: prompt}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			response, err := stream.CloseAndRecv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.GetResult() != test.want {
+				t.Errorf("Got %q, want %q", response.GetResult(), test.want)
+			}
+		})
+	}
+}
+
+// receiveAll reads a server stream to its end, returning the messages and the
+// final status.
+func receiveAll(stream interface {
+	Recv() (*pb.InferenceResponse, error)
+}) ([]*pb.InferenceResponse, error) {
+	var responses []*pb.InferenceResponse
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			return responses, nil
+		}
+		if err != nil {
+			return responses, err
+		}
+		responses = append(responses, response)
+	}
+}
+
+func TestStreamingResponseScore(t *testing.T) {
+	failing := &funcBackend{stream: func(ctx context.Context, prompt string, send func(string) error) error {
+		if err := send(prompt + " 0"); err != nil {
+			return err
+		}
+		return status.Error(codes.Unavailable, "model lost")
+	}}
+	tests := []struct {
+		name      string
+		resumeTTL time.Duration
+		backend   modelBackend
+		model     string
+		want      int
+		session   bool
+		code      codes.Code
+	}{
+		{name: "with sessions", resumeTTL: time.Minute, want: 10, session: true},
+		{name: "without sessions", want: 10},
+		{name: "unknown model", resumeTTL: time.Minute, model: "nope", code: codes.NotFound},
+		{name: "backend error", resumeTTL: time.Minute, backend: failing, want: 1, session: true, code: codes.Unavailable},
+		{name: "backend error without sessions", backend: failing, want: 1, code: codes.Unavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, resumeTTL, test.resumeTTL)
+			server := startTestServer(t)
+			if test.backend != nil {
+				server.setBackend(t, defaultModelName, test.backend)
+			}
+			stream, err := server.client.StreamingResponseScore(testContext(t), &pb.InferenceRequest{Prompt: "p", Model: test.model})
+			if err != nil {
+				t.Fatal(err)
+			}
+			responses, err := receiveAll(stream)
+			checkCode(t, err, test.code)
+			if len(responses) != test.want {
+				t.Fatalf("Got %d messages, want %d", len(responses), test.want)
+			}
+			for i, response := range responses {
+				if want := fmt.Sprintf("p %d", i); response.GetResult() != want || response.GetSequence() != int64(i+1) {
+					t.Errorf("Message %d is %q #%d, want %q #%d", i, response.GetResult(), response.GetSequence(), want, i+1)
+				}
+			}
+			header, _ := stream.Header()
+			if session := firstValue(header, streamSessionHeader); (session != "") != test.session {
+				t.Errorf("Got session %q, want one: %v", session, test.session)
+			}
+		})
+	}
+}
+
+func TestGenerationParameters(t *testing.T) {
+	server := startTestServer(t)
+	score := func(parameters *pb.GenerationParameters) string {
+		t.Helper()
+		response, err := server.client.Score(testContext(t), &pb.InferenceRequest{Prompt: "Today is", Parameters: parameters})
+		checkCode(t, err, codes.OK)
+		return response.GetResult()
+	}
+
+	if result := score(&pb.GenerationParameters{MaxTokens: 2}); result != "Today is" {
+		t.Errorf("With max_tokens 2 got %q", result)
+	}
+	sampled := score(&pb.GenerationParameters{Temperature: 1, Seed: 7})
+	if !strings.HasPrefix(sampled, "Today is ") {
+		t.Errorf("Sampled %q", sampled)
+	}
+	for i := 0; i < 3; i++ {
+		if again := score(&pb.GenerationParameters{Temperature: 1, Seed: 7, MaxTokens: 3}); again != sampled {
+			t.Errorf("Seed 7 sampled %q, then %q", sampled, again)
+		}
+	}
+
+	stream, err := server.client.StreamingResponseScore(testContext(t), &pb.InferenceRequest{Prompt: "p", Parameters: &pb.GenerationParameters{MaxTokens: 5}})
+	checkCode(t, err, codes.OK)
+	responses, err := receiveAll(stream)
+	checkCode(t, err, codes.OK)
+	var results []string
+	for _, response := range responses {
+		results = append(results, response.GetResult())
+	}
+	if got := strings.Join(results, "|"); got != "p 0|p 1|p" {
+		t.Errorf("With max_tokens 5 streamed %q", got)
+	}
+}
+
+func TestResumeStreamingResponseScore(t *testing.T) {
+	server := startTestServer(t)
+	stream, err := server.client.StreamingResponseScore(testContext(t), &pb.InferenceRequest{Prompt: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiveAll(stream); err != nil {
+		t.Fatal(err)
+	}
+	header, _ := stream.Header()
+	session := firstValue(header, streamSessionHeader)
+
+	tests := []struct {
+		name    string
+		session string
+		tenant  string
+		last    int64
+		first   int64
+		want    int
+		code    codes.Code
+	}{
+		{name: "from the start", session: session, first: 1, want: 10},
+		{name: "midway", session: session, last: 4, first: 5, want: 6},
+		{name: "at the end", session: session, last: 10},
+		{name: "beyond the end", session: session, last: 11, code: codes.OutOfRange},
+		{name: "negative sequence", session: session, last: -1, code: codes.OutOfRange},
+		{name: "unknown session", session: "nope", code: codes.NotFound},
+		{name: "other tenant", session: session, tenant: "other", code: codes.NotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := testContext(t)
+			if test.tenant != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, tenantHeader, test.tenant)
+			}
+			resumed, err := server.client.ResumeStreamingResponseScore(ctx, &pb.ResumeRequest{SessionId: test.session, LastSequence: test.last})
+			if err != nil {
+				t.Fatal(err)
+			}
+			responses, err := receiveAll(resumed)
+			checkCode(t, err, test.code)
+			if len(responses) != test.want {
+				t.Fatalf("Got %d messages, want %d", len(responses), test.want)
+			}
+			if len(responses) > 0 && responses[0].GetSequence() != test.first {
+				t.Errorf("First message is #%d, want #%d", responses[0].GetSequence(), test.first)
+			}
+		})
+	}
+}
+
+func TestStreamSessionLimits(t *testing.T) {
+	t.Run("max sessions", func(t *testing.T) {
+		setFlag(t, resumeMaxSessions, 1)
+		server := startTestServer(t)
+		backend, _ := blockingBackend()
+		server.setBackend(t, defaultModelName, backend)
+		stream, err := server.client.StreamingResponseScore(testContext(t), &pb.InferenceRequest{Prompt: "p"})
+		checkCode(t, err, codes.OK)
+		if _, err := stream.Recv(); err != nil {
+			t.Fatal(err)
+		}
+		second, err := server.client.StreamingResponseScore(testContext(t), &pb.InferenceRequest{Prompt: "q"})
+		checkCode(t, err, codes.OK)
+		_, err = second.Recv()
+		checkCode(t, err, codes.ResourceExhausted)
+	})
+	t.Run("grace", func(t *testing.T) {
+		setFlag(t, resumeGrace, 20*time.Millisecond)
+		server := startTestServer(t)
+		backend, cancelled := blockingBackend()
+		server.setBackend(t, defaultModelName, backend)
+		ctx, cancel := context.WithCancel(testContext(t))
+		stream, err := server.client.StreamingResponseScore(ctx, &pb.InferenceRequest{Prompt: "p"})
+		checkCode(t, err, codes.OK)
+		if _, err := stream.Recv(); err != nil {
+			t.Fatal(err)
+		}
+		header, _ := stream.Header()
+		cancel()
+		<-cancelled
+
+		resumed, err := server.client.ResumeStreamingResponseScore(testContext(t), &pb.ResumeRequest{SessionId: firstValue(header, streamSessionHeader), LastSequence: 1})
+		checkCode(t, err, codes.OK)
+		_, err = receiveAll(resumed)
+		checkCode(t, err, codes.Aborted)
+	})
+	t.Run("max bytes", func(t *testing.T) {
+		output := newFlightStream(context.Background(), func() {}, 8)
+		for _, chunk := range []string{"aaa", "bbb"} {
+			checkCode(t, output.append(chunk), codes.OK)
+		}
+		// Nothing was delivered yet, so nothing can be dropped.
+		checkCode(t, output.append("ccc"), codes.ResourceExhausted)
+
+		errStop := errors.New("stop")
+		err := output.follow(testContext(t), 0, func(chunk string, sequence int64) error {
+			if sequence > 1 {
+				return errStop
+			}
+			return nil
+		})
+		if err != errStop {
+			t.Fatal(err)
+		}
+		checkCode(t, output.append("ccc"), codes.OK)
+		checkCode(t, output.check(0), codes.OutOfRange)
+		checkCode(t, output.check(1), codes.OK)
+	})
+}
+
+// TestSlowReader holds a client back from reading while the backend streams,
+// with resume sessions enabled, to check that each buffer policy reaches the
+// backend.
+func TestSlowReader(t *testing.T) {
+	const chunks, chunkSize = 100, 16 << 10
+	tests := []struct {
+		policy string
+		code   codes.Code
+	}{
+		{policy: blockPolicy},
+		{policy: coalescePolicy},
+		{policy: abortPolicy, code: codes.ResourceExhausted},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			setFlag(t, resumeTTL, time.Minute)
+			setFlag(t, resumeMaxBytes, 4<<20)
+			setFlag(t, streamBufferSize, 4)
+			setFlag(t, streamBufferPolicy, test.policy)
+			server := startTestServer(t)
+			var produced int64
+			finished := make(chan struct{})
+			server.setBackend(t, defaultModelName, &funcBackend{stream: func(ctx context.Context, prompt string, send func(string) error) error {
+				defer close(finished)
+				chunk := strings.Repeat("x", chunkSize)
+				for i := 0; i < chunks; i++ {
+					if err := send(chunk); err != nil {
+						return err
+					}
+					atomic.AddInt64(&produced, 1)
+				}
+				return nil
+			}})
+			// Fixed windows keep flow control from absorbing the stream.
+			conn, err := grpc.Dial(server.address, grpc.WithInsecure(), grpc.WithInitialWindowSize(64<<10), grpc.WithInitialConnWindowSize(64<<10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			stream, err := pb.NewScorerClient(conn).StreamingResponseScore(testContext(t), &pb.InferenceRequest{Prompt: "p"})
+			checkCode(t, err, codes.OK)
+
+			if test.policy == blockPolicy {
+				time.Sleep(100 * time.Millisecond)
+				if n := atomic.LoadInt64(&produced); n >= chunks/2 {
+					t.Errorf("Backend produced %d of %d chunks for a client reading none", n, chunks)
+				}
+			} else {
+				<-finished
+			}
+			responses, err := receiveAll(stream)
+			checkCode(t, err, test.code)
+			total := 0
+			for _, response := range responses {
+				total += len(response.GetResult())
+			}
+			switch {
+			case test.policy == blockPolicy && len(responses) != chunks:
+				t.Errorf("Got %d messages, want all %d", len(responses), chunks)
+			case test.policy == coalescePolicy && (total != chunks*chunkSize || len(responses) >= chunks):
+				t.Errorf("Got %d bytes in %d messages, want %d bytes in fewer than %d", total, len(responses), chunks*chunkSize, chunks)
+			case test.policy == abortPolicy && len(responses) >= chunks:
+				t.Errorf("Got all %d messages before the abort", len(responses))
+			}
+		})
+	}
+}
+
+// TestBufferDeadline checks that stream buffers fail waiting callers with a
+// gRPC status rather than the bare context error.
+func TestBufferDeadline(t *testing.T) {
+	tests := []struct {
+		name string
+		wait func(ctx context.Context) error
+	}{
+		{name: "buffered send", wait: func(ctx context.Context) error {
+			unblock := make(chan struct{})
+			time.AfterFunc(50*time.Millisecond, func() { close(unblock) })
+			return bufferedSend(ctx, func(context.Context, func(*pb.InferenceResponse) error) error {
+				<-unblock
+				return nil
+			}, func(*pb.InferenceResponse) error { return nil })
+		}},
+		{name: "follow", wait: func(ctx context.Context) error {
+			return newFlightStream(ctx, func() {}, 0).follow(ctx, 0, func(string, int64) error { return nil })
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+			defer cancel()
+			checkCode(t, test.wait(ctx), codes.DeadlineExceeded)
+		})
+	}
+}
+
+func TestBidirectionalScore(t *testing.T) {
+	server := startTestServer(t)
+	tests := []struct {
+		name     string
+		window   int
+		requests []*pb.InferenceRequest
+		want     map[string]string
+		code     codes.Code
+	}{
+		{
+			name:     "tagged requests",
+			window:   16,
+			requests: []*pb.InferenceRequest{{Prompt: "a", RequestId: "x"}, {Prompt: "b", RequestId: "y"}, {Prompt: "c", RequestId: "z"}},
+			want:     map[string]string{"x": "a sunny", "y": "b sunny", "z": "c sunny"},
+		},
+		{
+			name:     "untagged requests are numbered",
+			window:   16,
+			requests: []*pb.InferenceRequest{{Prompt: "a"}, {Prompt: "b"}},
+			want:     map[string]string{"1": "a sunny", "2": "b sunny"},
+		},
+		{
+			name:     "window of one",
+			window:   1,
+			requests: []*pb.InferenceRequest{{Prompt: "a"}, {Prompt: "b"}, {Prompt: "c"}},
+			want:     map[string]string{"1": "a sunny", "2": "b sunny", "3": "c sunny"},
+		},
+		{name: "no requests", window: 16, want: map[string]string{}},
+		{
+			name:     "unknown model",
+			window:   16,
+			requests: []*pb.InferenceRequest{{Prompt: "a", Model: "nope"}},
+			want:     map[string]string{},
+			code:     codes.NotFound,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setFlag(t, bidiWindow, test.window)
+			stream, err := server.client.BidirectionalScore(testContext(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				for _, request := range test.requests {
+					if stream.Send(request) != nil {
+						return
+					}
+				}
+				stream.CloseSend()
+			}()
+			responses, err := receiveAll(stream)
+			checkCode(t, err, test.code)
+			got := map[string]string{}
+			for _, response := range responses {
+				got[response.GetRequestId()] = response.GetResult()
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("Got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// chat sends messages on a chat stream, returning the answers, the session
+// and the final status.
+func chat(ctx context.Context, client pb.ScorerClient, session string, requests ...*pb.InferenceRequest) ([]*pb.InferenceResponse, string, error) {
+	stream, err := client.BidirectionalScore(metadata.AppendToOutgoingContext(ctx, chatSessionHeader, session))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, request := range requests {
+		if err := stream.Send(request); err != nil {
+			break
+		}
+	}
+	stream.CloseSend()
+	responses, err := receiveAll(stream)
+	header, _ := stream.Header()
+	return responses, firstValue(header, chatSessionHeader), err
+}
+
+func TestChat(t *testing.T) {
+	server := startTestServer(t)
+	ctx := testContext(t)
+
+	t.Run("conversation", func(t *testing.T) {
+		responses, session, err := chat(ctx, server.client, newChatSession,
+			&pb.InferenceRequest{Role: systemRole, Prompt: "Be brief."},
+			&pb.InferenceRequest{Prompt: "Today is"},
+			&pb.InferenceRequest{Prompt: "And tomorrow?"},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if session == "" || session == newChatSession {
+			t.Errorf("Got session %q", session)
+		}
+		if len(responses) != 2 || responses[0].GetTurn() != 1 || responses[1].GetTurn() != 2 {
+			t.Fatalf("Got %v, want turns 1 and 2", responses)
+		}
+		if !strings.HasPrefix(responses[1].GetResult(), "system: Be brief.\nuser: Today is\n") {
+			t.Errorf("Second turn lacks the history: %q", responses[1].GetResult())
+		}
+	})
+
+	t.Run("reattach", func(t *testing.T) {
+		_, session, err := chat(ctx, server.client, newChatSession, &pb.InferenceRequest{Prompt: "Today is"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses, reattached, err := chat(ctx, server.client, session, &pb.InferenceRequest{Prompt: "And tomorrow?"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reattached != session || len(responses) != 1 || responses[0].GetTurn() != 2 {
+			t.Errorf("Reattaching to %s gave session %s and %v, want turn 2", session, reattached, responses)
+		}
+	})
+
+	t.Run("failed turn", func(t *testing.T) {
+		const maxBytes = 200
+		sessions := newChatSessions(time.Minute, maxBytes, 10)
+		session := &chatSession{}
+		if _, err := sessions.turn(ctx, session, &funcBackend{}, chatMessage{Role: userRole, Content: "Today is"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		before := fmt.Sprint(session.history, session.size)
+		failing := &funcBackend{score: func(context.Context, string) (string, error) {
+			return "", status.Error(codes.Unavailable, "backend down")
+		}}
+		// Fits only once every earlier message is trimmed.
+		long := chatMessage{Role: userRole, Content: strings.Repeat("a", maxBytes-len(userRole))}
+		_, err := sessions.turn(ctx, session, failing, long, nil)
+		checkCode(t, err, codes.Unavailable)
+		if after := fmt.Sprint(session.history, session.size); after != before {
+			t.Errorf("History went from %s to %s after a failed turn", before, after)
+		}
+	})
+
+	errorTests := []struct {
+		name    string
+		session string
+		request *pb.InferenceRequest
+		code    codes.Code
+	}{
+		{name: "unknown session", session: "nope", request: &pb.InferenceRequest{Prompt: "hi"}, code: codes.NotFound},
+		{name: "unknown role", session: newChatSession, request: &pb.InferenceRequest{Role: "robot", Prompt: "hi"}, code: codes.InvalidArgument},
+		{name: "unknown model", session: newChatSession, request: &pb.InferenceRequest{Model: "nope", Prompt: "hi"}, code: codes.NotFound},
+	}
+	for _, test := range errorTests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := chat(ctx, server.client, test.session, test.request)
+			checkCode(t, err, test.code)
+		})
+	}
+}
+
+// TestCancellation checks that a call the client abandons, or whose deadline
+// passes, stops its backend work.
+func TestCancellation(t *testing.T) {
+	calls := []struct {
+		name string
+		call func(ctx context.Context, client pb.ScorerClient) error
+	}{
+		{"Score", func(ctx context.Context, client pb.ScorerClient) error {
+			_, err := client.Score(ctx, &pb.InferenceRequest{Prompt: "p"})
+			return err
+		}},
+		{"StreamingResponseScore", func(ctx context.Context, client pb.ScorerClient) error {
+			stream, err := client.StreamingResponseScore(ctx, &pb.InferenceRequest{Prompt: "p"})
+			if err != nil {
+				return err
+			}
+			_, err = receiveAll(stream)
+			return err
+		}},
+		{"BidirectionalScore", func(ctx context.Context, client pb.ScorerClient) error {
+			stream, err := client.BidirectionalScore(ctx)
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(&pb.InferenceRequest{Prompt: "p"}); err != nil {
+				return err
+			}
+			_, err = receiveAll(stream)
+			return err
+		}},
+	}
+	ends := []struct {
+		name    string
+		context func() (context.Context, context.CancelFunc)
+		code    codes.Code
+	}{
+		{"cancelled", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			return ctx, cancel
+		}, codes.Canceled},
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}, codes.DeadlineExceeded},
+	}
+
+	// Resumable sessions deliberately outlive their client, so they are off.
+	setFlag(t, resumeTTL, 0)
+	for _, call := range calls {
+		for _, end := range ends {
+			t.Run(call.name+" "+end.name, func(t *testing.T) {
+				server := startTestServer(t)
+				backend, cancelled := blockingBackend()
+				server.setBackend(t, defaultModelName, backend)
+
+				ctx, cancel := end.context()
+				defer cancel()
+				checkCode(t, call.call(ctx, server.client), end.code)
+				select {
+				case <-cancelled:
+				case <-time.After(2 * time.Second):
+					t.Fatal("The backend was not cancelled")
+				}
+			})
+		}
+	}
+}
@@ -2,67 +2,392 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	pb "azuremachinelearning.com/scorer"
+	"azuremachinelearning.com/scorer/compression"
+	inference "azuremachinelearning.com/scorer/inference"
 	"github.com/soheilhy/cmux"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	listenAddress       = flag.String("listen", ":5001", "Address the shared gRPC and HTTP port listens on")
+	modelConfigPath     = flag.String("model-config", "", "JSON file listing models, their versions and traffic split")
+	modelRepositoryPath = flag.String("model-repository", "", "Directory of per-model JSON manifests to load and watch")
+	modelPollInterval   = flag.Duration("model-poll-interval", 5*time.Second, "How often the model repository is rescanned")
+	cacheMaxBytes       = flag.Int("cache-max-bytes", 64<<20, "Size limit of the unary response cache in bytes, 0 disables it")
+	cacheTTL            = flag.Duration("cache-ttl", 10*time.Minute, "How long cached unary responses stay valid")
+	coalesce            = flag.Bool("coalesce", true, "Share one backend call between identical concurrent deterministic requests")
+	tlsCertPath         = flag.String("tls-cert", "", "PEM certificate to terminate TLS on the shared port, e.g. ../contract/server.crt")
+	tlsKeyPath          = flag.String("tls-key", "", "PEM private key matching -tls-cert")
+	bidiWindow          = flag.Int("bidi-window", 16, "Requests of a BidirectionalScore stream scored concurrently before the server stops reading")
 )
 
 func main() {
-	listener, err := net.Listen("tcp", ":5001")
+	flag.Parse()
+	compression.SetMinSize(*compressionMinBytes)
+	if *bidiWindow < 1 {
+		log.Fatalf("Invalid flags: -bidi-window must be at least 1")
+	}
+	if *streamBufferSize < 1 || !validBufferPolicy(*streamBufferPolicy) {
+		log.Fatalf("Invalid flags: -stream-buffer must be at least 1 and -stream-buffer-policy one of block, coalesce or abort")
+	}
+	if *resumeMaxBytes < 1 {
+		log.Fatalf("Invalid flags: -resume-max-bytes must be at least 1")
+	}
+	if err := loadAdminToken(); err != nil {
+		log.Fatalf("Invalid flags: %v", err)
+	}
+	level, err := parseLogLevel(*logLevelName)
 	if err != nil {
-		log.Printf("Exception occured %v", err)
+		log.Fatalf("Invalid flags: -log-level: %v", err)
 	}
+	setLogLevel(level)
 
+	registry := newModelRegistry()
+	if *modelConfigPath != "" {
+		if err := registry.loadModelConfig(*modelConfigPath); err != nil {
+			log.Fatalf("Could not load model config: %v", err)
+		}
+	}
+	var repository *modelRepository
+	if *modelRepositoryPath != "" {
+		repository = newModelRepository(*modelRepositoryPath, registry)
+		if err := repository.sync(); err != nil {
+			log.Fatalf("Could not load model repository: %v", err)
+		}
+		go repository.watch(*modelPollInterval, nil)
+	}
+	if registry.get(defaultModelName) == nil {
+		registry.add(modelConfig{
+			Name:     defaultModelName,
+			Versions: []versionConfig{{Name: "v1", Weight: 100}},
+		})
+	}
+
+	listener, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		log.Fatalf("Could not listen on %s: %v", *listenAddress, err)
+	}
+	if *tlsCertPath != "" {
+		certificate, err := tls.LoadX509KeyPair(*tlsCertPath, *tlsKeyPath)
+		if err != nil {
+			log.Fatalf("Could not load TLS certificate: %v", err)
+		}
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			NextProtos:   []string{"h2", "http/1.1"},
+		})
+	}
+
+	var scorer pb.ScorerServer = newScorerServer(registry)
+	if *gatewayConfigPath != "" {
+		gw, err := loadGateway(*gatewayConfigPath)
+		if err != nil {
+			log.Fatalf("Could not load gateway config: %v", err)
+		}
+		infof("Gateway mode: forwarding Scorer calls to %d upstreams", len(gw.upstreams))
+		scorer = gw
+	}
+	var recorder *recorder
+	if *recordPath != "" {
+		if recorder, err = newRecorder(*recordPath); err != nil {
+			log.Fatalf("Could not open recording file: %v", err)
+		}
+		infof("Recording %v of Scorer calls to %s", *recordSample, *recordPath)
+	}
+	var faults *faultInjector
+	if *faultConfigPath != "" || *faultMetadata {
+		if faults, err = loadFaults(*faultConfigPath, *faultMetadata); err != nil {
+			log.Fatalf("Could not load fault config: %v", err)
+		}
+		infof("Injecting faults: %d rules, from metadata %v", len(faults.faults), *faultMetadata)
+	}
+	var calls *callTracker
+	if *adminListenAddress != "" {
+		calls = newCallTracker()
+		reload := func() error {
+			if *modelConfigPath != "" {
+				if err := registry.loadModelConfig(*modelConfigPath); err != nil {
+					return err
+				}
+			}
+			if repository != nil {
+				return repository.reload()
+			}
+			return nil
+		}
+		adminListener, err := net.Listen("tcp", *adminListenAddress)
+		if err != nil {
+			log.Fatalf("Could not listen for the admin API: %v", err)
+		}
+		infof("Admin API listening on %s", adminListener.Addr())
+		go func() {
+			log.Fatalf("While serving the admin API: %v", serveAdmin(adminListener, adminHandler(registry, calls, reload)))
+		}()
+	}
+	if err := serve(listener, registry, scorer, recorder, faults, calls); err != nil {
+		log.Fatalf("While serving: %v", err)
+	}
+}
+
+// serve splits the shared port between gRPC and the HTTP handlers, returning
+// once the listener is closed.
+func serve(listener net.Listener, registry *modelRegistry, scorer pb.ScorerServer, recorder *recorder, faults *faultInjector, calls *callTracker) error {
+	// gRPC is recognized by its content-type rather than by being HTTP/2, so
+	// plain HTTP/2 requests (h2c or TLS with ALPN h2) reach the HTTP handlers.
 	tcpmux := cmux.New(listener)
 
 	httpListener := tcpmux.Match(cmux.HTTP1Fast())
-	grpcListener := tcpmux.Match(cmux.Any())
+	grpcListener := tcpmux.MatchWithWriters(cmux.HTTP2MatchHeaderFieldPrefixSendSettings("content-type", "application/grpc"))
+	http2Listener := tcpmux.Match(cmux.HTTP2())
+	unknownListener := tcpmux.Match(cmux.Any())
+
+	grpcServer := newGRPCServer(registry, scorer, recorder, faults, calls)
+	defer grpcServer.Stop()
+	if faults != nil {
+		grpcListener = faults.listener(grpcListener)
+	}
+	handler := httpHandler(registry, scorer, newCallChain(recorder, faults, calls))
+	if calls != nil {
+		handler = calls.httpHandler(handler)
+	}
+	httpServer := &http.Server{Handler: h2c.NewHandler(handler, http2Server())}
+	defer httpServer.Close()
+	go httpServer.Serve(muxListener(httpListener, settingsAckListener{http2Listener}))
+	go grpcServer.Serve(grpcListener)
+	go rejectUnrecognized(unknownListener)
+
+	return tcpmux.Serve()
+}
+
+func newGRPCServer(registry *modelRegistry, scorer pb.ScorerServer, recorder *recorder, faults *faultInjector, calls *callTracker) *grpc.Server {
+	options := append(serverOptions(), newCallChain(recorder, faults, calls).serverOptions()...)
+	grpcServer := grpc.NewServer(options...)
+	pb.RegisterScorerServer(grpcServer, scorer)
+	inference.RegisterGRPCInferenceServiceServer(grpcServer, &inferenceServer{registry: registry})
+
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	reflection.Register(grpcServer)
+	registry.subscribe(func(status modelStatus) {
+		healthServer.SetServingStatus(status.Name, servingStatus(status))
+	})
+	if calls != nil {
+		// A draining server reports every service as not serving, and
+		// restores the model states when it serves again.
+		calls.onDrain(func(draining bool) {
+			if draining {
+				healthServer.Shutdown()
+				return
+			}
+			healthServer.Resume()
+			for _, status := range registry.list() {
+				healthServer.SetServingStatus(status.Name, servingStatus(status))
+			}
+		})
+	}
+	return grpcServer
+}
+
+// callChain holds the interceptors of the optional components that every
+// Scorer call passes through, whether it arrives over gRPC or Connect.
+type callChain struct {
+	unary  []grpc.UnaryServerInterceptor
+	stream []grpc.StreamServerInterceptor
+}
+
+func newCallChain(recorder *recorder, faults *faultInjector, calls *callTracker) callChain {
+	var chain callChain
+	if calls != nil {
+		chain.unary = append(chain.unary, calls.unaryInterceptor)
+		chain.stream = append(chain.stream, calls.streamInterceptor)
+	}
+	if recorder != nil {
+		chain.unary = append(chain.unary, recorder.unaryInterceptor)
+		chain.stream = append(chain.stream, recorder.streamInterceptor)
+	}
+	// Faults run inside the recorder, which captures what clients saw.
+	if faults != nil {
+		chain.unary = append(chain.unary, faults.unaryInterceptor)
+		chain.stream = append(chain.stream, faults.streamInterceptor)
+	}
+	return chain
+}
 
-	go serveHTTP(httpListener)
-	go serveGRPC(grpcListener)
+func (c callChain) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(c.unary...),
+		grpc.ChainStreamInterceptor(c.stream...),
+	}
+}
+
+// callUnary runs handler behind the unary interceptors, first one outermost,
+// as grpc.ChainUnaryInterceptor does.
+func (c callChain) callUnary(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	for i := len(c.unary) - 1; i >= 0; i-- {
+		interceptor, next := c.unary[i], handler
+		handler = func(ctx context.Context, request interface{}) (interface{}, error) {
+			return interceptor(ctx, request, info, next)
+		}
+	}
+	return handler(ctx, request)
+}
 
-	tcpmux.Serve()
-	select {}
+// callStream runs handler behind the stream interceptors.
+func (c callChain) callStream(server interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	for i := len(c.stream) - 1; i >= 0; i-- {
+		interceptor, next := c.stream[i], handler
+		handler = func(server interface{}, stream grpc.ServerStream) error {
+			return interceptor(server, stream, info, next)
+		}
+	}
+	return handler(server, stream)
 }
 
-func serveGRPC(listener net.Listener) {
-	grpcServer := grpc.NewServer()
-	pb.RegisterScorerServer(grpcServer, &scorerServer{})
-	if err := grpcServer.Serve(listener); err != nil {
-		log.Fatalf("While serving gRpc request: %v", err)
+// servingStatus maps a model load state onto the gRPC health protocol, where
+// each model is checked as its own service name.
+func servingStatus(status modelStatus) healthpb.HealthCheckResponse_ServingStatus {
+	switch status.State {
+	case modelReady:
+		return healthpb.HealthCheckResponse_SERVING
+	case "":
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+	default:
+		return healthpb.HealthCheckResponse_NOT_SERVING
 	}
 }
 
-func serveHTTP(listener net.Listener) {
-	http.HandleFunc("/healthcheck", healthcheck)
-	if err := http.Serve(listener, nil); err != nil {
-		log.Fatalf("While serving http request: %v", err)
+// httpHandler routes the HTTP side of the shared port.
+func httpHandler(registry *modelRegistry, scorer pb.ScorerServer, chain callChain) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthcheck", healthcheck)
+	mux.HandleFunc("/healthcheck/models", func(w http.ResponseWriter, r *http.Request) {
+		modelHealthcheck(w, r, registry)
+	})
+	if gw, ok := scorer.(*gateway); ok {
+		mux.HandleFunc("/healthcheck/upstreams", gw.healthcheck)
 	}
+	registerOpenAIHandlers(mux, registry)
+	registerConnectHandlers(mux, scorer, chain)
+	return mux
 }
 
 func healthcheck(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Healthcheck Receieved connection %v", r.Proto)
+	debugf("Healthcheck Receieved connection %v", r.Proto)
 	w.WriteHeader(http.StatusOK)
-	log.Printf("Healthcheck Writing response %v", r.Proto)
+	debugf("Healthcheck Writing response %v", r.Proto)
 	fmt.Fprint(w, "ok")
 }
 
+// modelHealthcheck reports the load state of every model, failing when any
+// model could not be loaded.
+func modelHealthcheck(w http.ResponseWriter, r *http.Request, registry *modelRegistry) {
+	statuses := registry.list()
+	code := http.StatusOK
+	for _, status := range statuses {
+		if status.State == modelFailed || status.State == modelLoading {
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(statuses)
+}
+
 type scorerServer struct {
 	pb.UnimplementedScorerServer
+	registry *modelRegistry
+	cache    *responseCache
+	flights  *flightGroup
+	streams  *streamGroup
+	sessions *streamSessions
+	chats    *chatSessions
+}
+
+func newScorerServer(registry *modelRegistry) *scorerServer {
+	scorer := &scorerServer{registry: registry}
+	if *cacheMaxBytes > 0 {
+		scorer.cache = newResponseCache(*cacheMaxBytes, *cacheTTL)
+	}
+	if *resumeTTL > 0 && *resumeMaxSessions > 0 {
+		scorer.sessions = newStreamSessions(*resumeTTL, *resumeGrace, *resumeMaxBytes, *resumeMaxSessions)
+	}
+	if *chatMaxSessions > 0 {
+		scorer.chats = newChatSessions(*chatTTL, *chatMaxBytes, *chatMaxSessions)
+	}
+	if *coalesce {
+		scorer.flights = newFlightGroup()
+		scorer.streams = newStreamGroup()
+	}
+	return scorer
 }
 
 func (s *scorerServer) Score(ctx context.Context, request *pb.InferenceRequest) (*pb.InferenceResponse, error) {
-	log.Printf("Unary Received: %v", request.GetPrompt())
+	debugf("Unary Received: %v", request.GetPrompt())
+	version, err := s.registry.route(ctx, request.GetModel())
+	if err != nil {
+		return nil, err
+	}
+	defer version.release()
+	if err := grpc.SetHeader(ctx, version.header()); err != nil {
+		return nil, err
+	}
+
+	key, deterministic := requestKey(version, request)
+	cacheable, lookup, store := false, false, false
+	if s.cache != nil {
+		cacheable = deterministic
+		md, _ := metadata.FromIncomingContext(ctx)
+		lookup, store = cacheControl(md)
+	}
+	if cacheable && lookup {
+		if result, ok := s.cache.get(key); ok {
+			grpc.SetHeader(ctx, metadata.Pairs(cacheStatusHeader, "hit"))
+			return &pb.InferenceResponse{
+				Result: result,
+			}, nil
+		}
+	}
+
+	var result string
+	if s.flights != nil && deterministic {
+		result, _, err = s.flights.do(ctx, key, func(ctx context.Context) (string, error) {
+			return version.backend.Score(ctx, request.GetPrompt(), request.GetParameters())
+		})
+	} else {
+		result, err = version.backend.Score(ctx, request.GetPrompt(), request.GetParameters())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cacheable && store {
+		s.cache.put(key, result)
+		grpc.SetHeader(ctx, metadata.Pairs(cacheStatusHeader, "miss"))
+	} else if s.cache != nil {
+		grpc.SetHeader(ctx, metadata.Pairs(cacheStatusHeader, "bypass"))
+	}
 	return &pb.InferenceResponse{
-		Result: request.GetPrompt() + " sunny",
+		Result: result,
 	}, nil
 }
 
@@ -72,7 +397,7 @@ func (s *scorerServer) StreamingRequestScore(stream pb.Scorer_StreamingRequestSc
 		request, err := stream.Recv()
 		if err == io.EOF {
 			finalResult := strings.Join(result, "__") + " END"
-			log.Printf("cStream End of streaming request, will return the response %s", finalResult)
+			debugf("cStream End of streaming request, will return the response %s", finalResult)
 			return stream.SendAndClose(&pb.InferenceResponse{
 				Result: finalResult,
 			})
@@ -81,51 +406,183 @@ func (s *scorerServer) StreamingRequestScore(stream pb.Scorer_StreamingRequestSc
 			return nil
 		}
 		if len(result) == 1 {
-			log.Println("cStream First response received from client")
+			debugf("cStream First response received from client")
 		}
 		result = append(result, request.GetPrompt())
 	}
 }
 
 func (s *scorerServer) StreamingResponseScore(request *pb.InferenceRequest, stream pb.Scorer_StreamingResponseScoreServer) error {
-	prompt := request.GetPrompt()
-	log.Println("sStream Sending first response for the Server Streaming request")
-	for i := 0; i < 10; i++ {
-		result := fmt.Sprintf("%s %v", prompt, i)
-		error := stream.Send(&pb.InferenceResponse{
-			Result: result,
+	version, err := s.registry.route(stream.Context(), request.GetModel())
+	if err != nil {
+		return err
+	}
+	generate := func(ctx context.Context, send func(string) error) error {
+		produce := func(ctx context.Context, send func(string) error) error {
+			return version.backend.StreamScore(ctx, request.GetPrompt(), request.GetParameters(), send)
+		}
+		if key, deterministic := requestKey(version, request); s.streams != nil && deterministic {
+			shared, err := s.streams.stream(ctx, key, produce, send)
+			if shared {
+				debugf("sStream Joined an identical stream already in flight")
+			}
+			return err
+		}
+		return produce(ctx, send)
+	}
+
+	debugf("sStream Sending first response for the Server Streaming request")
+	if s.sessions != nil {
+		// The session owns the version until generation ends, so a client
+		// can resume after its connection drops.
+		var session *streamSession
+		session, err = s.sessions.start(stream.Context(), version.header(), func(ctx context.Context, send func(string) error) error {
+			defer version.release()
+			return generate(ctx, send)
 		})
-		if error != nil {
-			log.Printf("Error in processing Server streaming request %v", error)
+		if err != nil {
+			version.release()
+			return err
 		}
-		time.Sleep(250 * time.Millisecond)
+		if err := stream.SetHeader(session.header); err != nil {
+			return err
+		}
+		// The session output is the stream's buffer, so the producer is held
+		// back by the buffer policy while the client falls behind.
+		err = s.sessions.follow(stream.Context(), session, 0, stream.Send)
+	} else {
+		defer version.release()
+		if err := stream.SetHeader(version.header()); err != nil {
+			return err
+		}
+		err = bufferedSend(stream.Context(), func(ctx context.Context, send func(*pb.InferenceResponse) error) error {
+			var sequence int64
+			return generate(ctx, func(result string) error {
+				sequence++
+				return send(&pb.InferenceResponse{
+					Result:   result,
+					Sequence: sequence,
+				})
+			})
+		}, stream.Send)
 	}
-	log.Println("sStream Sent all the request to client")
+	if err != nil {
+		warningf("Error in processing Server streaming request %v", err)
+		return err
+	}
+	debugf("sStream Sent all the request to client")
 	return nil
 }
 
+// ResumeStreamingResponseScore continues a StreamingResponseScore stream
+// after the last message the client received.
+func (s *scorerServer) ResumeStreamingResponseScore(request *pb.ResumeRequest, stream pb.Scorer_ResumeStreamingResponseScoreServer) error {
+	if s.sessions == nil {
+		return status.Error(codes.Unimplemented, "resuming streams is disabled")
+	}
+	session := s.sessions.get(stream.Context(), request.GetSessionId())
+	if session == nil {
+		return status.Errorf(codes.NotFound, "stream session %q is unknown or expired", request.GetSessionId())
+	}
+	if err := stream.SetHeader(session.header); err != nil {
+		return err
+	}
+	debugf("sStream Resuming session %s after sequence %d", session.id, request.GetLastSequence())
+	sessionMetrics.Add("resumed", 1)
+	return s.sessions.follow(stream.Context(), session, request.GetLastSequence(), stream.Send)
+}
+
+// BidirectionalScore scores requests concurrently as they arrive and sends
+// each result as soon as it is ready, tagged with its request ID. At most
+// bidi-window requests are in flight; reading stops while the window is full
+// so flow control holds back a client sending faster than the model answers.
 func (s *scorerServer) BidirectionalScore(stream pb.Scorer_BidirectionalScoreServer) error {
-	log.Println("BiDi Starting the bidirectional request processing")
-	result := []string{"BATCH START "}
-	for i := 0; i < 10; i++ {
-		request, error := stream.Recv()
-		if error != nil {
-			log.Printf("Could not process bidirection request %v", error)
-			return error
-		} else {
-			result = append(result, request.GetPrompt())
-		}
-
-		if i%2 == 0 {
-			batchResult := strings.Join(result, "__") + " BATCH END"
-			log.Printf("BiDi Sending current stream response %s", batchResult)
-			stream.Send(&pb.InferenceResponse{
-				Result: batchResult,
-			})
-			result = []string{"BATCH START "}
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if id := firstValue(md, chatSessionHeader); id != "" {
+		return s.chat(stream, id)
+	}
+	debugf("BiDi Starting the bidirectional request processing")
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	window := make(chan struct{}, *bidiWindow)
+	responses := make(chan *pb.InferenceResponse)
+	errs := make(chan error, 1)
+	fail := func(err error) {
+		select {
+		case errs <- err:
+		default:
 		}
-		time.Sleep(125 * time.Millisecond)
+		cancel()
 	}
-	log.Println("BiDi Ending the bidirectional request processing")
-	return nil
+
+	go func() {
+		var inFlight sync.WaitGroup
+		for n := 1; ; n++ {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			request, err := stream.Recv()
+			if err == io.EOF {
+				inFlight.Wait()
+				close(responses)
+				return
+			}
+			if err != nil {
+				warningf("Could not process bidirection request %v", err)
+				fail(err)
+				return
+			}
+			id := request.GetRequestId()
+			if id == "" {
+				id = strconv.Itoa(n)
+			}
+			inFlight.Add(1)
+			go func() {
+				defer inFlight.Done()
+				result, err := s.scoreRequest(ctx, request)
+				if err != nil {
+					fail(err)
+					return
+				}
+				select {
+				case responses <- &pb.InferenceResponse{Result: result, RequestId: id}:
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}()
+
+	for {
+		select {
+		case response, ok := <-responses:
+			if !ok {
+				debugf("BiDi Ending the bidirectional request processing")
+				return nil
+			}
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+			<-window
+		case <-ctx.Done():
+			select {
+			case err := <-errs:
+				return err
+			default:
+				return contextStatus(ctx)
+			}
+		}
+	}
+}
+
+// scoreRequest runs one request against the version routed for it.
+func (s *scorerServer) scoreRequest(ctx context.Context, request *pb.InferenceRequest) (string, error) {
+	version, err := s.registry.route(ctx, request.GetModel())
+	if err != nil {
+		return "", err
+	}
+	defer version.release()
+	return version.backend.Score(ctx, request.GetPrompt(), request.GetParameters())
 }
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// latencyConfig describes a latency distribution. Durations use Go syntax
+// such as "120ms".
+//
+//	fixed:     value
+//	normal:    mean and stddev
+//	lognormal: median and sigma, the standard deviation of the log
+//	histogram: file, with one "<latency> <weight>" bucket per line
+//
+// Samples are clamped to [0, max] when max is set.
+type latencyConfig struct {
+	Distribution string  `json:"distribution"`
+	Value        string  `json:"value,omitempty"`
+	Mean         string  `json:"mean,omitempty"`
+	Stddev       string  `json:"stddev,omitempty"`
+	Median       string  `json:"median,omitempty"`
+	Sigma        float64 `json:"sigma,omitempty"`
+	File         string  `json:"file,omitempty"`
+	Max          string  `json:"max,omitempty"`
+}
+
+// latency draws durations from a distribution using the caller's source.
+type latency func(rng *rand.Rand) time.Duration
+
+func newLatency(config *latencyConfig) (latency, error) {
+	if config == nil {
+		return func(*rand.Rand) time.Duration { return 0 }, nil
+	}
+	durations := map[string]time.Duration{}
+	for name, value := range map[string]string{"value": config.Value, "mean": config.Mean, "stddev": config.Stddev, "median": config.Median, "max": config.Max} {
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", name, value, err)
+		}
+		durations[name] = d
+	}
+
+	var sample latency
+	switch config.Distribution {
+	case "fixed":
+		value := durations["value"]
+		sample = func(*rand.Rand) time.Duration { return value }
+	case "normal":
+		mean, stddev := float64(durations["mean"]), float64(durations["stddev"])
+		sample = func(rng *rand.Rand) time.Duration { return time.Duration(mean + stddev*rng.NormFloat64()) }
+	case "lognormal":
+		if durations["median"] <= 0 {
+			return nil, fmt.Errorf("lognormal latency needs a positive median")
+		}
+		mu, sigma := math.Log(float64(durations["median"])), config.Sigma
+		sample = func(rng *rand.Rand) time.Duration { return time.Duration(math.Exp(mu + sigma*rng.NormFloat64())) }
+	case "histogram":
+		buckets, err := loadHistogram(config.File)
+		if err != nil {
+			return nil, err
+		}
+		sample = buckets.sample
+	default:
+		return nil, fmt.Errorf("unknown latency distribution %q", config.Distribution)
+	}
+
+	max, capped := durations["max"]
+	return func(rng *rand.Rand) time.Duration {
+		d := sample(rng)
+		if d < 0 {
+			d = 0
+		}
+		if capped && d > max {
+			d = max
+		}
+		return d
+	}, nil
+}
+
+// histogram holds latency buckets by upper bound with cumulative weights. A
+// sample picks a bucket by weight and a uniform latency within it.
+type histogram struct {
+	bounds     []time.Duration
+	cumulative []float64
+}
+
+func loadHistogram(path string) (*histogram, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	type bucket struct {
+		bound  time.Duration
+		weight float64
+	}
+	var buckets []bucket
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"<latency> <weight>\"", path, line)
+		}
+		bound, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		weight, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("%s:%d: invalid weight %q", path, line, fields[1])
+		}
+		buckets = append(buckets, bucket{bound, weight})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].bound < buckets[j].bound })
+
+	h := &histogram{}
+	total := 0.0
+	for _, b := range buckets {
+		total += b.weight
+		h.bounds = append(h.bounds, b.bound)
+		h.cumulative = append(h.cumulative, total)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("%s has no weighted buckets", path)
+	}
+	return h, nil
+}
+
+func (h *histogram) sample(rng *rand.Rand) time.Duration {
+	target := rng.Float64() * h.cumulative[len(h.cumulative)-1]
+	i := sort.SearchFloat64s(h.cumulative, target)
+	if i == len(h.bounds) {
+		i--
+	}
+	var lower time.Duration
+	if i > 0 {
+		lower = h.bounds[i-1]
+	}
+	return lower + time.Duration(rng.Float64()*float64(h.bounds[i]-lower))
+}
+
+// injectedError fails the given fraction of calls with a gRPC code.
+type injectedError struct {
+	code codes.Code
+	rate float64
+}
+
+// simulatedBackend stands in for a real model under load tests. It answers
+// like the echo backend after delays drawn from its latency distributions,
+// and fails a configured fraction of calls. Streams fail after a random
+// number of chunks so clients see errors midway too.
+type simulatedBackend struct {
+	suffix     string
+	chunks     int
+	latency    latency
+	firstToken latency
+	interToken latency
+	errors     []injectedError
+	rng        *rand.Rand
+}
+
+func newSimulatedBackend(config backendConfig) (*simulatedBackend, error) {
+	b := &simulatedBackend{suffix: "sunny", chunks: 10}
+	if config.Suffix != "" {
+		b.suffix = config.Suffix
+	}
+	if config.Chunks > 0 {
+		b.chunks = config.Chunks
+	}
+	var err error
+	if b.latency, err = newLatency(config.Latency); err != nil {
+		return nil, fmt.Errorf("latency: %v", err)
+	}
+	if b.firstToken, err = newLatency(config.FirstToken); err != nil {
+		return nil, fmt.Errorf("firstToken: %v", err)
+	}
+	if b.interToken, err = newLatency(config.InterToken); err != nil {
+		return nil, fmt.Errorf("interToken: %v", err)
+	}
+
+	total := 0.0
+	for name, rate := range config.Errors {
+		code, err := parseCode(name)
+		if err != nil {
+			return nil, fmt.Errorf("errors: %v", err)
+		}
+		if rate < 0 {
+			return nil, fmt.Errorf("errors: negative rate for %s", name)
+		}
+		b.errors = append(b.errors, injectedError{code: code, rate: rate})
+		total += rate
+	}
+	if total > 1 {
+		return nil, fmt.Errorf("errors: rates add up to %v, more than 1", total)
+	}
+	sort.Slice(b.errors, func(i, j int) bool { return b.errors[i].code < b.errors[j].code })
+
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	b.rng = rand.New(&lockedSource{source: rand.NewSource(seed)})
+	return b, nil
+}
+
+// random returns the source a call draws from. A request seed makes the
+// call's latencies and failures reproducible on its own; otherwise calls share
+// the backend's source.
+func (b *simulatedBackend) random(parameters *pb.GenerationParameters) *rand.Rand {
+	if parameters.GetSeed() != 0 {
+		return generationRand(parameters)
+	}
+	return b.rng
+}
+
+// injected picks the error a call fails with, if any.
+func (b *simulatedBackend) injected(rng *rand.Rand) error {
+	roll := rng.Float64()
+	for _, e := range b.errors {
+		if roll < e.rate {
+			return status.Errorf(e.code, "simulated %s", e.code)
+		}
+		roll -= e.rate
+	}
+	return nil
+}
+
+func (b *simulatedBackend) Score(ctx context.Context, prompt string, parameters *pb.GenerationParameters) (string, error) {
+	rng := b.random(parameters)
+	err := b.injected(rng)
+	if err := sleep(ctx, b.latency(rng)); err != nil {
+		return "", err
+	}
+	if err != nil {
+		return "", err
+	}
+	return complete(ctx, prompt, b.suffix, parameters), nil
+}
+
+func (b *simulatedBackend) StreamScore(ctx context.Context, prompt string, parameters *pb.GenerationParameters, send func(string) error) error {
+	rng := b.random(parameters)
+	err := b.injected(rng)
+	failAt := b.chunks
+	if err != nil {
+		failAt = rng.Intn(b.chunks + 1)
+	}
+	if err := sleep(ctx, b.firstToken(rng)); err != nil {
+		return err
+	}
+	sent := 0
+	for i := 0; i < b.chunks; i++ {
+		if i == failAt {
+			return err
+		}
+		if i > 0 {
+			if err := sleep(ctx, b.interToken(rng)); err != nil {
+				return err
+			}
+		}
+		chunk, spent := limitTokens(ctx, fmt.Sprintf("%s %v", prompt, i), &sent, parameters)
+		if err := send(chunk); err != nil {
+			return err
+		}
+		if spent {
+			if i+1 < b.chunks {
+				markTruncated(ctx)
+			}
+			return nil
+		}
+	}
+	return err
+}
+
+// lockedSource makes a random source safe for concurrent calls.
+type lockedSource struct {
+	mu     sync.Mutex
+	source rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.source.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.source.Seed(seed)
+}
+
+// sleep waits for d unless ctx ends first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return contextStatus(ctx)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return contextStatus(ctx)
+	}
+}
+
+// contextStatus reports why ctx ended as a gRPC status, so a call that gives
+// up before its client does fails with DeadlineExceeded or Canceled rather
+// than Unknown.
+func contextStatus(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return nil
+}
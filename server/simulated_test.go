@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	pb "azuremachinelearning.com/scorer"
+	"google.golang.org/grpc/codes"
+)
+
+func TestLatency(t *testing.T) {
+	histogram := filepath.Join(t.TempDir(), "latency.txt")
+	if err := os.WriteFile(histogram, []byte("# p50 under 100ms, tail to 1s\n100ms 50\n\n1s 50\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		config   *latencyConfig
+		min, max time.Duration
+		median   [2]time.Duration
+	}{
+		{name: "none", max: 0},
+		{name: "fixed", config: &latencyConfig{Distribution: "fixed", Value: "20ms"}, min: 20 * time.Millisecond, max: 20 * time.Millisecond},
+		{
+			name:   "normal",
+			config: &latencyConfig{Distribution: "normal", Mean: "100ms", Stddev: "10ms"},
+			max:    200 * time.Millisecond, median: [2]time.Duration{95 * time.Millisecond, 105 * time.Millisecond},
+		},
+		{
+			name:   "normal clamped",
+			config: &latencyConfig{Distribution: "normal", Mean: "0s", Stddev: "10ms", Max: "5ms"},
+			max:    5 * time.Millisecond,
+		},
+		{
+			name:   "lognormal",
+			config: &latencyConfig{Distribution: "lognormal", Median: "50ms", Sigma: 1},
+			max:    10 * time.Second, median: [2]time.Duration{45 * time.Millisecond, 55 * time.Millisecond},
+		},
+		{
+			name:   "histogram",
+			config: &latencyConfig{Distribution: "histogram", File: histogram},
+			max:    time.Second, median: [2]time.Duration{50 * time.Millisecond, 150 * time.Millisecond},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sample, err := newLatency(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rng := rand.New(rand.NewSource(1))
+			samples := make([]time.Duration, 2001)
+			for i := range samples {
+				samples[i] = sample(rng)
+			}
+			sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+			if samples[0] < test.min || samples[len(samples)-1] > test.max {
+				t.Errorf("Samples range over [%v, %v], want within [%v, %v]", samples[0], samples[len(samples)-1], test.min, test.max)
+			}
+			if median := samples[len(samples)/2]; test.median[1] > 0 && (median < test.median[0] || median > test.median[1]) {
+				t.Errorf("Median %v, want within %v", median, test.median)
+			}
+		})
+	}
+}
+
+func TestSimulatedBackendConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config backendConfig
+	}{
+		{name: "unknown distribution", config: backendConfig{Latency: &latencyConfig{Distribution: "uniform"}}},
+		{name: "invalid duration", config: backendConfig{FirstToken: &latencyConfig{Distribution: "fixed", Value: "fast"}}},
+		{name: "lognormal without median", config: backendConfig{InterToken: &latencyConfig{Distribution: "lognormal", Sigma: 1}}},
+		{name: "missing histogram", config: backendConfig{Latency: &latencyConfig{Distribution: "histogram", File: "nope.txt"}}},
+		{name: "unknown code", config: backendConfig{Errors: map[string]float64{"BROKEN": 0.1}}},
+		{name: "rates over 1", config: backendConfig{Errors: map[string]float64{"UNAVAILABLE": 0.6, "INTERNAL": 0.6}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.Type = "simulated"
+			if _, err := newBackend(test.config); err == nil {
+				t.Error("Got no error")
+			}
+		})
+	}
+}
+
+func TestSimulatedBackend(t *testing.T) {
+	model := func(name string, errors map[string]float64) modelConfig {
+		return modelConfig{Name: name, Versions: []versionConfig{{Name: "v1", Weight: 100, Backend: backendConfig{
+			Type:       "simulated",
+			Latency:    &latencyConfig{Distribution: "fixed", Value: "20ms"},
+			FirstToken: &latencyConfig{Distribution: "fixed", Value: "20ms"},
+			InterToken: &latencyConfig{Distribution: "fixed", Value: "1ms"},
+			Errors:     errors,
+			Seed:       1,
+		}}}}
+	}
+	server := startTestServer(t, testModel, model("healthy", nil), model("unavailable", map[string]float64{"UNAVAILABLE": 1}))
+
+	t.Run("latency", func(t *testing.T) {
+		start := time.Now()
+		response, err := server.client.Score(testContext(t), &pb.InferenceRequest{Prompt: "Today is", Model: "healthy"})
+		checkCode(t, err, codes.OK)
+		if response.GetResult() != "Today is sunny" {
+			t.Errorf("Got result %q", response.GetResult())
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("Answered after %v, before the fixed 20ms latency", elapsed)
+		}
+	})
+	t.Run("stream", func(t *testing.T) {
+		stream, err := server.client.StreamingResponseScore(testContext(t), &pb.InferenceRequest{Prompt: "Today is", Model: "healthy"})
+		checkCode(t, err, codes.OK)
+		responses, err := receiveAll(stream)
+		checkCode(t, err, codes.OK)
+		if len(responses) != 10 {
+			t.Errorf("Got %d chunks, want 10", len(responses))
+		}
+	})
+	t.Run("seeded stream", func(t *testing.T) {
+		// The request seed decides where the stream fails, and max_tokens
+		// where it ends.
+		failures := func() []int {
+			var got []int
+			for i := 0; i < 2; i++ {
+				request := &pb.InferenceRequest{Prompt: "p", Model: "unavailable", Parameters: &pb.GenerationParameters{Seed: 3, MaxTokens: 12}}
+				stream, err := server.client.StreamingResponseScore(testContext(t), request)
+				checkCode(t, err, codes.OK)
+				responses, _ := receiveAll(stream)
+				got = append(got, len(responses))
+			}
+			return got
+		}
+		if got := failures(); got[0] != got[1] || got[0] > 6 {
+			t.Errorf("Seeded streams failed after %v chunks", got)
+		}
+	})
+	t.Run("injected error", func(t *testing.T) {
+		_, err := server.client.Score(testContext(t), &pb.InferenceRequest{Prompt: "Today is", Model: "unavailable"})
+		checkCode(t, err, codes.Unavailable)
+	})
+	t.Run("injected stream error", func(t *testing.T) {
+		stream, err := server.client.StreamingResponseScore(testContext(t), &pb.InferenceRequest{Prompt: "Today is", Model: "unavailable"})
+		checkCode(t, err, codes.OK)
+		responses, err := receiveAll(stream)
+		checkCode(t, err, codes.Unavailable)
+		if len(responses) > 10 {
+			t.Errorf("Got %d chunks before the error", len(responses))
+		}
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		defer cancel()
+		_, err := server.client.Score(ctx, &pb.InferenceRequest{Prompt: "Tomorrow is", Model: "healthy"})
+		checkCode(t, err, codes.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// HTTP/2 transport tuning. Zero values keep the gRPC defaults.
+var (
+	keepaliveTime          = flag.Duration("keepalive-time", 2*time.Hour, "Ping clients after this long without activity")
+	keepaliveTimeout       = flag.Duration("keepalive-timeout", 20*time.Second, "Close the connection when a keepalive ping is not acknowledged in time")
+	keepaliveMinTime       = flag.Duration("keepalive-min-time", 10*time.Second, "Minimum interval between client pings before the connection is closed with too_many_pings")
+	keepaliveWithoutStream = flag.Bool("keepalive-permit-without-stream", true, "Allow client pings on connections with no active RPCs")
+	maxConnectionIdle      = flag.Duration("max-connection-idle", 15*time.Minute, "Close connections idle for this long, 0 disables")
+	maxConnectionAge       = flag.Duration("max-connection-age", 30*time.Minute, "Send GOAWAY after a connection reaches this age so clients rebalance, 0 disables")
+	maxConnectionAgeGrace  = flag.Duration("max-connection-age-grace", 5*time.Minute, "Time in-flight RPCs get to finish after max-connection-age, 0 waits indefinitely")
+	maxConcurrentStreams   = flag.Uint("max-concurrent-streams", 0, "Limit on concurrent streams per HTTP/2 connection, 0 is unlimited")
+	initialWindowSize      = flag.Int("initial-window-size", 0, "Per-stream HTTP/2 flow control window in bytes, at least 64KiB")
+	initialConnWindowSize  = flag.Int("initial-conn-window-size", 0, "Per-connection HTTP/2 flow control window in bytes, at least 64KiB")
+	readBufferSize         = flag.Int("read-buffer-size", 0, "Transport read buffer size in bytes")
+	writeBufferSize        = flag.Int("write-buffer-size", 0, "Transport write buffer size in bytes")
+)
+
+// serverOptions builds the gRPC server transport options from the flags.
+func serverOptions() []grpc.ServerOption {
+	options := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:                  *keepaliveTime,
+			Timeout:               *keepaliveTimeout,
+			MaxConnectionIdle:     *maxConnectionIdle,
+			MaxConnectionAge:      *maxConnectionAge,
+			MaxConnectionAgeGrace: *maxConnectionAgeGrace,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             *keepaliveMinTime,
+			PermitWithoutStream: *keepaliveWithoutStream,
+		}),
+	}
+	if *maxConcurrentStreams > 0 {
+		options = append(options, grpc.MaxConcurrentStreams(uint32(*maxConcurrentStreams)))
+	}
+	if *initialWindowSize > 0 {
+		options = append(options, grpc.InitialWindowSize(int32(*initialWindowSize)))
+	}
+	if *initialConnWindowSize > 0 {
+		options = append(options, grpc.InitialConnWindowSize(int32(*initialConnWindowSize)))
+	}
+	if *readBufferSize > 0 {
+		options = append(options, grpc.ReadBufferSize(*readBufferSize))
+	}
+	if *writeBufferSize > 0 {
+		options = append(options, grpc.WriteBufferSize(*writeBufferSize))
+	}
+	return options
+}
+
+// http2Server applies the matching limits to the plain HTTP/2 handlers.
+func http2Server() *http2.Server {
+	server := &http2.Server{
+		MaxConcurrentStreams: uint32(*maxConcurrentStreams),
+		IdleTimeout:          *maxConnectionIdle,
+	}
+	if *initialWindowSize > 0 {
+		server.MaxUploadBufferPerStream = int32(*initialWindowSize)
+	}
+	if *initialConnWindowSize > 0 {
+		server.MaxUploadBufferPerConnection = int32(*initialConnWindowSize)
+	}
+	return server
+}